@@ -0,0 +1,208 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MutatedAnnotation lists the rules applied to a pod, when enabled
+const MutatedAnnotation = "think8shook.io/mutated"
+
+// mutationRecord describes a mutation for the audit log and the user.
+// Records with an empty rule only carry a warning, or the source.
+type mutationRecord struct {
+	// path of the patch the record belongs to
+	path    string
+	rule    string
+	value   string
+	warning string
+	// source is the mutationRule that changed the object at path
+	source string
+}
+
+// audit records that rule was applied by the patch at path. The API server
+// prefixes the rule with the webhook name in the audit annotations, so it
+// must be a valid label name.
+func (ps *patchSet) audit(path, rule, value string) {
+	ps.records = append(ps.records, mutationRecord{path: path, rule: rule, value: value})
+}
+
+// warn records a warning for the user about the patch at path
+func (ps *patchSet) warn(path, format string, args ...interface{}) {
+	ps.records = append(ps.records, mutationRecord{path: path, warning: fmt.Sprintf(format, args...)})
+}
+
+// recordRule records that the mutation rule changed the object at path,
+// if before and after differ. The record path is the first field changed,
+// so that it is filtered out along with the patch on updates.
+func (ps *patchSet) recordRule(name, path string, before, after interface{}) error {
+	changes := &patchSet{}
+	if err := changes.appendDiff(path, before, after); err != nil {
+		return err
+	}
+	if len(changes.patches) > 0 {
+		ps.records = append(ps.records, mutationRecord{path: changes.patches[0].Path, source: name})
+	}
+	return nil
+}
+
+// sources returns the mutation rules applied, in order
+func (ps patchSet) sources() []string {
+	var sources []string
+	for _, record := range ps.records {
+		if record.source != "" && !slices.Contains(sources, record.source) {
+			sources = append(sources, record.source)
+		}
+	}
+	return sources
+}
+
+// auditAnnotations summarizes the records by rule, joining the
+// distinct values of each rule with commas
+func (ps patchSet) auditAnnotations() map[string]string {
+	values := make(map[string][]string)
+	for _, record := range ps.records {
+		if record.rule != "" && !slices.Contains(values[record.rule], record.value) {
+			values[record.rule] = append(values[record.rule], record.value)
+		}
+	}
+	if sources := ps.sources(); len(sources) > 0 {
+		values[rulesAuditKey] = sources
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	annotations := make(map[string]string, len(values))
+	for rule, v := range values {
+		annotations[rule] = strings.Join(v, ",")
+	}
+	return annotations
+}
+
+// warnings returns the warnings recorded, in order
+func (ps patchSet) warnings() []string {
+	var warnings []string
+	for _, record := range ps.records {
+		if record.warning != "" {
+			warnings = append(warnings, record.warning)
+		}
+	}
+	return warnings
+}
+
+// annotateMutated adds a patch stamping the rules applied on the pod
+// metadata. The patch is computed against the pod with the previous
+// patches applied, so that annotations added by the rules are kept.
+// Nothing is added if no rule was applied.
+func (ps *patchSet) annotateMutated(raw []byte) error {
+	rules := ps.sources()
+	if len(rules) == 0 {
+		return nil
+	}
+	mutated, err := applyPatch(raw, ps)
+	if err != nil {
+		return err
+	}
+	return newPodEditor(mutated, ps).edit(func(pod *corev1.Pod) error {
+		metav1.SetMetaDataAnnotation(&pod.ObjectMeta, MutatedAnnotation, strings.Join(rules, ","))
+		return nil
+	})
+}
+
+// escapePathSegment escapes a JSON pointer segment as defined in RFC 6901
+func escapePathSegment(segment string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(segment)
+}
+
+// auditPodSecurityContext records the changes between the pod
+// securityContext before and after the mutation
+func auditPodSecurityContext(path string, before, after *corev1.PodSecurityContext, ps *patchSet) {
+	if before == nil {
+		before = &corev1.PodSecurityContext{}
+	}
+	if before.RunAsUser == nil && after.RunAsUser != nil {
+		ps.audit(path, "injected-uid", strconv.FormatInt(*after.RunAsUser, 10))
+	}
+	if before.RunAsGroup == nil && after.RunAsGroup != nil {
+		ps.audit(path, "injected-gid", strconv.FormatInt(*after.RunAsGroup, 10))
+	}
+	if before.FSGroup == nil && after.FSGroup != nil {
+		ps.audit(path, "injected-fsgroup", strconv.FormatInt(*after.FSGroup, 10))
+	}
+	if before.RunAsNonRoot == nil && after.RunAsNonRoot != nil {
+		ps.audit(path, "injected-run-as-non-root", strconv.FormatBool(*after.RunAsNonRoot))
+	}
+	switch {
+	case after.SeccompProfile == nil:
+	case before.SeccompProfile == nil:
+		ps.audit(path, "injected-seccomp-profile", string(after.SeccompProfile.Type))
+	case before.SeccompProfile.Type != after.SeccompProfile.Type:
+		ps.audit(path, "replaced-seccomp-profile", string(after.SeccompProfile.Type))
+		ps.warn(path, "seccompProfile %s was replaced by %s in the pod securityContext", before.SeccompProfile.Type, after.SeccompProfile.Type)
+	}
+}
+
+// auditContainerSecurityContext records the changes between the container
+// securityContext before and after the mutation
+func auditContainerSecurityContext(path, name string, before, after *corev1.SecurityContext, ps *patchSet) {
+	if before == nil {
+		before = &corev1.SecurityContext{}
+	}
+	isTrue := func(b *bool) bool { return b != nil && *b }
+	if isTrue(before.Privileged) && !isTrue(after.Privileged) {
+		ps.audit(path, "removed-privileged", name)
+		ps.warn(path, "privileged=true was removed from container %q", name)
+	}
+	switch {
+	case isTrue(before.AllowPrivilegeEscalation) && !isTrue(after.AllowPrivilegeEscalation):
+		ps.audit(path, "removed-privilege-escalation", name)
+		ps.warn(path, "allowPrivilegeEscalation=true was removed from container %q", name)
+	case before.AllowPrivilegeEscalation == nil && after.AllowPrivilegeEscalation != nil:
+		ps.audit(path, "disabled-privilege-escalation", name)
+	}
+	if before.SeccompProfile != nil && after.SeccompProfile == nil {
+		ps.audit(path, "removed-seccomp-profile", name)
+		ps.warn(path, "seccompProfile %s was removed from container %q", before.SeccompProfile.Type, name)
+	}
+	var beforeCaps, afterCaps corev1.Capabilities
+	if before.Capabilities != nil {
+		beforeCaps = *before.Capabilities
+	}
+	if after.Capabilities != nil {
+		afterCaps = *after.Capabilities
+	}
+	if !slices.Contains(beforeCaps.Drop, "ALL") && slices.Contains(afterCaps.Drop, "ALL") {
+		ps.audit(path, "dropped-capabilities", name)
+	}
+	var removed []string
+	for _, capability := range beforeCaps.Add {
+		if !slices.Contains(afterCaps.Add, capability) {
+			removed = append(removed, string(capability))
+		}
+	}
+	if len(removed) > 0 {
+		ps.audit(path, "removed-capabilities", name)
+		ps.warn(path, "capabilities %s were removed from container %q", strings.Join(removed, ","), name)
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/warpcomdev/think8shook/internal/webhook"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestMutatedAnnotation(t *testing.T) {
+	privileged := true
+	podSpec := corev1.PodSpec{
+		SecurityContext: &corev1.PodSecurityContext{},
+		Containers: []corev1.Container{{
+			Name:            "test",
+			Image:           "busybox/latest",
+			SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+		}},
+	}
+	deploymentsResource := metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	rules := "pod-identity,run-as-non-root,seccomp-profile,remove-privileged,drop-capabilities"
+
+	testCases := []struct {
+		name        string
+		resource    metav1.GroupVersionResource
+		object      runtime.Object
+		annotations func(obj runtime.Object) map[string]string
+	}{
+		{
+			name:        "pod without annotations",
+			resource:    podsResource,
+			object:      &corev1.Pod{Spec: *podSpec.DeepCopy()},
+			annotations: func(obj runtime.Object) map[string]string { return obj.(*corev1.Pod).Annotations },
+		},
+		{
+			name:     "pod with annotations",
+			resource: podsResource,
+			object: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"existing": "true"}},
+				Spec:       *podSpec.DeepCopy(),
+			},
+			annotations: func(obj runtime.Object) map[string]string { return obj.(*corev1.Pod).Annotations },
+		},
+		{
+			name:     "deployment template",
+			resource: deploymentsResource,
+			object:   &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: *podSpec.DeepCopy()}}},
+			annotations: func(obj runtime.Object) map[string]string {
+				return obj.(*appsv1.Deployment).Spec.Template.Annotations
+			},
+		},
+	}
+	policy.AnnotateMutated = true
+	defer func() { policy = defaultPolicyConfig() }()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := mustMarshal(tc.object)
+			ar := v1.AdmissionReview{
+				Request: &v1.AdmissionRequest{
+					Resource:  tc.resource,
+					Namespace: "default",
+					Operation: v1.Create,
+					Object:    runtime.RawExtension{Raw: raw},
+				},
+			}
+			response := mutateSecurityContext(ar, webhook.Codecs())
+			require.True(t, response.Allowed)
+			require.Equal(t, []string{`privileged=true was removed from container "test"`}, response.Warnings)
+			require.Equal(t, "1000", response.AuditAnnotations["injected-uid"])
+			require.Equal(t, "test", response.AuditAnnotations["removed-privileged"])
+
+			patch, err := jsonpatch.DecodePatch(response.Patch)
+			require.NoError(t, err)
+			patched, err := patch.Apply(raw)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(patched, tc.object))
+			require.Equal(t, rules, tc.annotations(tc.object)[MutatedAnnotation])
+		})
+	}
+}
+
+func TestMutatedAnnotationKeepsRuleAnnotations(t *testing.T) {
+	cfg, err := loadTestPolicy(t, `
+apiVersion: think8shook.io/v1alpha1
+kind: HardeningPolicy
+metadata:
+  name: test
+spec:
+  annotateMutated: true
+  mutations:
+  - name: owner
+    actions:
+    - force:
+        field: metadata.annotations.owner
+        value: platform
+`)
+	require.NoError(t, err)
+	policy = cfg
+	defer func() { policy = defaultPolicyConfig() }()
+	// The pod has no annotations, so both must come from the same map
+	raw := mustMarshal(corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "test", Image: "busybox/latest"}}}})
+	ar := v1.AdmissionReview{
+		Request: &v1.AdmissionRequest{
+			Resource:  podsResource,
+			Namespace: "default",
+			Operation: v1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	response := mutateSecurityContext(ar, webhook.Codecs())
+	require.True(t, response.Allowed)
+	patch, err := jsonpatch.DecodePatch(response.Patch)
+	require.NoError(t, err)
+	patched, err := patch.Apply(raw)
+	require.NoError(t, err)
+	var mutated corev1.Pod
+	require.NoError(t, json.Unmarshal(patched, &mutated))
+	require.Equal(t, map[string]string{"owner": "platform", MutatedAnnotation: "owner"}, mutated.Annotations)
+}
+
+func TestAuditOnUpdate(t *testing.T) {
+	privileged := true
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"updated": "true"}},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:            "test",
+				Image:           "busybox/latest",
+				SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+			}},
+		},
+	}
+	ar := v1.AdmissionReview{
+		Request: &v1.AdmissionRequest{
+			Resource:  podsResource,
+			Namespace: "default",
+			Operation: v1.Update,
+			Object:    runtime.RawExtension{Raw: mustMarshal(pod)},
+			OldObject: runtime.RawExtension{Raw: mustMarshal(corev1.Pod{Spec: pod.Spec})},
+		},
+	}
+	policy.AnnotateMutated = true
+	defer func() { policy = defaultPolicyConfig() }()
+	// Mutations discarded because the spec is immutable must not be reported
+	response := mutateSecurityContext(ar, webhook.Codecs())
+	require.True(t, response.Allowed)
+	require.Nil(t, response.Patch)
+	require.Empty(t, response.Warnings)
+	require.Empty(t, response.AuditAnnotations)
+}
@@ -0,0 +1,283 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+	v1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// Captured fixtures waiting to be written. Fixtures are dropped when
+// the queue is full, so that admission never waits for the disk.
+const captureQueueSize = 16
+
+// redactedValue replaces the environment values, commands and
+// arguments of captured pods
+const redactedValue = "REDACTED"
+
+// lastAppliedAnnotation is stripped from captured pods, it duplicates the pod
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// podFixture is a pod test case in cmd/pod_tests. The initial objects are
+// the pod, and optionally the namespace and the request user info.
+type podFixture struct {
+	Initial      map[string]json.RawMessage `json:"initial"`
+	Policy       json.RawMessage            `json:"policy,omitempty"`
+	ShouldMutate bool                       `json:"shouldMutate"`
+	Expected     []jsonPatch                `json:"expected"`
+	Violations   []string                   `json:"violations,omitempty"`
+	Warnings     []string                   `json:"warnings,omitempty"`
+	Audit        map[string]string          `json:"audit,omitempty"`
+}
+
+// capturedFixture is a fixture waiting to be written to disk
+type capturedFixture struct {
+	name string
+	data []byte
+}
+
+// admissionRecorder writes the pods admitted by the mutating webhook as
+// fixtures, so that real traffic can be replayed by TestSecurityPatches
+type admissionRecorder struct {
+	dir               string
+	namespaces        []string
+	excludeNamespaces []string
+	limiter           *rate.Limiter
+	fixtures          chan capturedFixture
+	now               func() time.Time
+	// maxFiles is the number of fixtures to capture before stopping,
+	// and captured the ones queued so far
+	maxFiles int64
+	captured atomic.Int64
+}
+
+// podRecorder captures the admitted pods. It is nil when capture is disabled.
+var podRecorder *admissionRecorder
+
+// newAdmissionRecorder creates a recorder writing at most perSecond
+// fixtures per second to dir, and maxFiles fixtures in total. If
+// namespaces is not empty, only pods in those namespaces are captured.
+func newAdmissionRecorder(dir string, namespaces, excludeNamespaces []string, perSecond float64, maxFiles int) (*admissionRecorder, error) {
+	if perSecond <= 0 {
+		return nil, fmt.Errorf("capture rate must be positive, got %v", perSecond)
+	}
+	if maxFiles <= 0 {
+		return nil, fmt.Errorf("capture max files must be positive, got %d", maxFiles)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &admissionRecorder{
+		dir:               dir,
+		namespaces:        namespaces,
+		excludeNamespaces: excludeNamespaces,
+		limiter:           rate.NewLimiter(rate.Limit(perSecond), 1),
+		fixtures:          make(chan capturedFixture, captureQueueSize),
+		now:               time.Now,
+		maxFiles:          int64(maxFiles),
+	}, nil
+}
+
+// Start writes the captured fixtures until the context is cancelled
+func (r *admissionRecorder) Start(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case fixture := <-r.fixtures:
+			path := filepath.Join(r.dir, fixture.name)
+			if err := os.WriteFile(path, fixture.data, 0o644); err != nil {
+				klog.Errorf("failed to write captured fixture %s: %v", path, err)
+				continue
+			}
+			klog.V(2).Infof("captured fixture %s", path)
+			if r.captured.Load() >= r.maxFiles && len(r.fixtures) == 0 {
+				klog.Infof("captured %d fixtures in %s, capture finished", r.maxFiles, r.dir)
+			}
+		}
+	}
+}
+
+// captures returns true if pods in the namespace must be captured
+func (r *admissionRecorder) captures(namespace string) bool {
+	if slices.Contains(r.excludeNamespaces, namespace) {
+		return false
+	}
+	return len(r.namespaces) == 0 || slices.Contains(r.namespaces, namespace)
+}
+
+// record queues a fixture for a pod being created. raw is the pod
+// before mutation, and ps the patches returned for it. Fixtures only
+// describe pod creation, so other requests are ignored.
+func (r *admissionRecorder) record(req *v1.AdmissionRequest, raw []byte, shouldMutate bool, ps *patchSet) {
+	if r == nil || req == nil {
+		return
+	}
+	if req.Resource != podsResource || req.SubResource != "" || req.Operation != v1.Create {
+		return
+	}
+	if r.captured.Load() >= r.maxFiles || !r.captures(req.Namespace) || !r.limiter.Allow() {
+		return
+	}
+
+	fixture, err := newPodFixture(req, raw, shouldMutate, ps)
+	if err != nil {
+		klog.Errorf("failed to capture pod %s/%s: %v", req.Namespace, req.Name, err)
+		return
+	}
+	data, err := yaml.Marshal(fixture)
+	if err != nil {
+		klog.Errorf("failed to capture pod %s/%s: %v", req.Namespace, req.Name, err)
+		return
+	}
+	// pods created by controllers only have a generateName
+	name := req.Name
+	if name == "" {
+		var meta metav1.PartialObjectMetadata
+		if err := json.Unmarshal(raw, &meta); err == nil {
+			name = strings.TrimSuffix(meta.GenerateName, "-")
+		}
+	}
+	if name == "" {
+		name = "pod"
+	}
+	header := fmt.Sprintf("# Capturado de %s/%s el %s\n", req.Namespace, name, r.now().UTC().Format(time.RFC3339))
+	captured := capturedFixture{
+		name: fmt.Sprintf("%s_%s_%d.yaml", req.Namespace, name, r.now().UnixNano()),
+		data: append([]byte(header), data...),
+	}
+	if r.captured.Add(1) > r.maxFiles {
+		r.captured.Add(-1)
+		return
+	}
+	select {
+	case r.fixtures <- captured:
+	default:
+		r.captured.Add(-1)
+		klog.Warningf("capture queue full, dropping fixture for pod %s/%s", req.Namespace, name)
+	}
+}
+
+// newPodFixture builds the fixture with the sanitized pod and the
+// results expected from the mutation under the current policy
+func newPodFixture(req *v1.AdmissionRequest, raw []byte, shouldMutate bool, ps *patchSet) (podFixture, error) {
+	fixture := podFixture{
+		Initial:      map[string]json.RawMessage{},
+		ShouldMutate: shouldMutate,
+		Expected:     append(make([]jsonPatch, 0, len(ps.patches)), ps.patches...),
+	}
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(raw, pod); err != nil {
+		return fixture, err
+	}
+	sanitizePod(pod)
+	var err error
+	if fixture.Initial["pod"], err = json.Marshal(pod); err != nil {
+		return fixture, err
+	}
+	if req.UserInfo.Username != "" || len(req.UserInfo.Groups) > 0 {
+		userInfo := authenticationv1.UserInfo{Username: req.UserInfo.Username, Groups: req.UserInfo.Groups}
+		if fixture.Initial["request"], err = json.Marshal(map[string]interface{}{"userInfo": userInfo}); err != nil {
+			return fixture, err
+		}
+	}
+	if namespaceLister != nil && pod.Namespace != "" {
+		if ns, err := namespaceLister.Get(pod.Namespace); err == nil {
+			sanitized := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:        ns.Name,
+				Labels:      ns.Labels,
+				Annotations: ns.Annotations,
+			}}
+			delete(sanitized.Annotations, lastAppliedAnnotation)
+			if fixture.Initial["namespace"], err = json.Marshal(sanitized); err != nil {
+				return fixture, err
+			}
+		}
+	}
+	if fixture.Policy, err = json.Marshal(policy); err != nil {
+		return fixture, err
+	}
+	fixture.Warnings = ps.warnings()
+	fixture.Audit = ps.auditAnnotations()
+	mutated, err := applyPatch(raw, ps)
+	if err != nil {
+		return fixture, err
+	}
+	fixture.Violations = validatePodSecurityContext(mutated)
+	if policy.Restricted {
+		fixture.Warnings = append(fixture.Warnings, restrictedWarnings(mutated)...)
+	}
+	return fixture, nil
+}
+
+// sanitizePod removes the fields set by the API server, and redacts the
+// environment values, commands and arguments, that may hold credentials.
+// None of them are inspected by the mutators. Labels and annotations are
+// kept, since exemptions, expressions and checks may read them.
+func sanitizePod(pod *corev1.Pod) {
+	meta := metav1.ObjectMeta{
+		Name:         pod.Name,
+		GenerateName: pod.GenerateName,
+		Namespace:    pod.Namespace,
+		Labels:       pod.Labels,
+		Annotations:  pod.Annotations,
+	}
+	if meta.Annotations != nil {
+		delete(meta.Annotations, lastAppliedAnnotation)
+	}
+	pod.ObjectMeta = meta
+	pod.Status = corev1.PodStatus{}
+	redact := func(env []corev1.EnvVar, command, args []string) {
+		for idx := range env {
+			if env[idx].Value != "" {
+				env[idx].Value = redactedValue
+			}
+		}
+		for _, values := range [][]string{command, args} {
+			for idx := range values {
+				values[idx] = redactedValue
+			}
+		}
+	}
+	for idx := range pod.Spec.InitContainers {
+		container := &pod.Spec.InitContainers[idx]
+		redact(container.Env, container.Command, container.Args)
+	}
+	for idx := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[idx]
+		redact(container.Env, container.Command, container.Args)
+	}
+	for idx := range pod.Spec.EphemeralContainers {
+		container := &pod.Spec.EphemeralContainers[idx]
+		redact(container.Env, container.Command, container.Args)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/warpcomdev/think8shook/internal/webhook"
+	"golang.org/x/time/rate"
+	v1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func capturedPod(namespace string) v1.AdmissionReview {
+	privileged := true
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName:  "web-7c9f8-",
+			Namespace:     namespace,
+			UID:           "0a4c5e0e-0000-0000-0000-000000000001",
+			ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kube-controller-manager"}},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:            "web",
+			Image:           "nginx",
+			Env:             []corev1.EnvVar{{Name: "PASSWORD", Value: "s3cr3t"}},
+			Command:         []string{"nginx"},
+			Args:            []string{"--password=t0k3n"},
+			SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+		}}},
+	}
+	return v1.AdmissionReview{Request: &v1.AdmissionRequest{
+		Resource:  podsResource,
+		Namespace: namespace,
+		Operation: v1.Create,
+		UserInfo:  authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:replicaset-controller", UID: "1234"},
+		Object:    runtime.RawExtension{Raw: mustMarshal(pod)},
+	}}
+}
+
+func TestCapture(t *testing.T) {
+	policy = defaultPolicyConfig()
+	dir := t.TempDir()
+	recorder, err := newAdmissionRecorder(dir, nil, []string{"kube-system"}, 1000, 10)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go recorder.Start(ctx)
+	podRecorder = recorder
+	defer func() { podRecorder = nil }()
+
+	mutateSecurityContext(capturedPod("kube-system"), webhook.Codecs())
+	response := mutateSecurityContext(capturedPod("default"), webhook.Codecs())
+	require.NotNil(t, response.Patch)
+
+	var files []string
+	require.Eventually(t, func() bool {
+		files, _ = filepath.Glob(filepath.Join(dir, "*.yaml"))
+		return len(files) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, files, 1)
+	require.Regexp(t, `^default_web-7c9f8_\d+\.yaml$`, filepath.Base(files[0]))
+
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	require.Contains(t, string(data), redactedValue)
+	require.NotContains(t, string(data), "s3cr3t")
+	require.NotContains(t, string(data), "t0k3n")
+	require.NotContains(t, string(data), "managedFields")
+	require.NotContains(t, string(data), "0a4c5e0e")
+	// The capture must be usable as a fixture as is
+	checkPodFixture(t, mutateRules, files[0])
+}
+
+func TestCaptureFilters(t *testing.T) {
+	recorder, err := newAdmissionRecorder(t.TempDir(), []string{"team-a", "team-b"}, []string{"team-b"}, 0.001, 10)
+	require.NoError(t, err)
+	require.True(t, recorder.captures("team-a"))
+	require.False(t, recorder.captures("team-b"))
+	require.False(t, recorder.captures("default"))
+
+	// Only the first request fits in the rate limit
+	ps := &patchSet{}
+	for range 3 {
+		review := capturedPod("team-a")
+		recorder.record(review.Request, review.Request.Object.Raw, false, ps)
+	}
+	require.Len(t, recorder.fixtures, 1)
+
+	// Updates can not be replayed as fixtures
+	recorder.limiter.SetBurst(10)
+	review := capturedPod("team-a")
+	review.Request.Operation = v1.Update
+	recorder.record(review.Request, review.Request.Object.Raw, false, ps)
+	require.Len(t, recorder.fixtures, 1)
+
+	_, err = newAdmissionRecorder(t.TempDir(), nil, nil, 0, 10)
+	require.Error(t, err)
+	_, err = newAdmissionRecorder(t.TempDir(), nil, nil, 1, 0)
+	require.Error(t, err)
+}
+
+func TestCaptureMaxFiles(t *testing.T) {
+	recorder, err := newAdmissionRecorder(t.TempDir(), nil, nil, 1000, 2)
+	require.NoError(t, err)
+	recorder.limiter = rate.NewLimiter(rate.Inf, 0)
+
+	// The capture stops after maxFiles fixtures
+	ps := &patchSet{}
+	for range 5 {
+		review := capturedPod("default")
+		recorder.record(review.Request, review.Request.Object.Raw, false, ps)
+	}
+	require.Len(t, recorder.fixtures, 2)
+}
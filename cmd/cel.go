@@ -0,0 +1,207 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/ext"
+	"github.com/warpcomdev/think8shook/internal/webhook"
+	"google.golang.org/protobuf/types/known/structpb"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/v2"
+)
+
+// celCostLimit bounds the evaluation cost of a single expression
+const celCostLimit = 1000000
+
+// celEnv declares the variables available to the expressions. They have
+// the Go types of the objects, with fields named after their JSON tags,
+// so field and type errors are found when the policy is loaded.
+var celEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		ext.NativeTypes(
+			reflect.TypeOf(&corev1.Pod{}),
+			reflect.TypeOf(&corev1.Namespace{}),
+			reflect.TypeOf(&v1.AdmissionRequest{}),
+			ext.ParseStructField(celFieldName),
+		),
+		cel.Variable("object", celObjectType(corev1.Pod{})),
+		cel.Variable("oldObject", celObjectType(corev1.Pod{})),
+		cel.Variable("request", celObjectType(v1.AdmissionRequest{})),
+		cel.Variable("namespaceObject", celObjectType(corev1.Namespace{})),
+		ext.Strings(),
+	)
+})
+
+// celFieldName names the fields after their JSON tag. Inlined and
+// ignored fields, that have no JSON name, keep their Go name.
+func celFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+// celObjectType returns the CEL type ext.NativeTypes declares for obj
+func celObjectType(obj interface{}) *cel.Type {
+	t := reflect.TypeOf(obj)
+	return cel.ObjectType(path.Base(t.PkgPath()) + "." + t.Name())
+}
+
+// celProgram is a compiled CEL expression
+type celProgram struct {
+	expression string
+	output     *cel.Type
+	program    cel.Program
+}
+
+// compileCEL parses and checks the expression
+func compileCEL(expression string) (*celProgram, error) {
+	env, err := celEnv()
+	if err != nil {
+		return nil, err
+	}
+	checked, issues := env.Compile(expression)
+	if issues.Err() != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", expression, issues.Err())
+	}
+	program, err := env.Program(checked, cel.CostLimit(celCostLimit))
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", expression, err)
+	}
+	return &celProgram{expression: expression, output: checked.OutputType(), program: program}, nil
+}
+
+// compileCELCondition compiles an expression that must return a bool
+func compileCELCondition(expression string) (*celProgram, error) {
+	p, err := compileCEL(expression)
+	if err != nil {
+		return nil, err
+	}
+	if !p.output.IsExactType(cel.BoolType) {
+		return nil, fmt.Errorf("expression %q must return bool, returns %s", expression, p.output)
+	}
+	return p, nil
+}
+
+// sample returns a value of the expression output type, to check it can be
+// assigned to a field. Returns false for objects, lists and maps, that
+// are checked when the expression runs.
+func (p *celProgram) sample() (interface{}, bool) {
+	switch p.output.Kind() {
+	case types.BoolKind:
+		return false, true
+	case types.IntKind, types.UintKind:
+		return int64(0), true
+	case types.DoubleKind:
+		return 0.5, true
+	case types.StringKind:
+		return "", true
+	}
+	return nil, false
+}
+
+// eval runs the expression with the variables
+func (p *celProgram) eval(vars map[string]interface{}) (ref.Val, error) {
+	out, _, err := p.program.Eval(vars)
+	if err != nil {
+		return nil, fmt.Errorf("expression %q failed: %w", p.expression, err)
+	}
+	return out, nil
+}
+
+// evalBool runs a condition
+func (p *celProgram) evalBool(vars map[string]interface{}) (bool, error) {
+	out, err := p.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	result, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q returned %s, expected bool", p.expression, out.Type())
+	}
+	return result, nil
+}
+
+// evalJSON runs the expression and returns the result as a JSON value
+func (p *celProgram) evalJSON(vars map[string]interface{}) (interface{}, error) {
+	out, err := p.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	if out == types.NullValue {
+		return nil, nil
+	}
+	// objects are Go values, marshaled with their JSON tags
+	if _, ok := out.Type().(*types.Type); !ok {
+		return toJSONValue(out.Value())
+	}
+	native, err := out.ConvertToNative(reflect.TypeOf(&structpb.Value{}))
+	if err != nil {
+		// lists and maps of Go values, like the object fields
+		if value, jsonErr := toJSONValue(out.Value()); jsonErr == nil {
+			return value, nil
+		}
+		return nil, fmt.Errorf("expression %q returned %s: %w", p.expression, out.Type(), err)
+	}
+	return toJSONValue(native.(*structpb.Value).AsInterface())
+}
+
+// celVariables returns the variables of the expressions: the pod being
+// mutated and the previous one on updates, the admission request and the
+// namespace of the pod, if the namespace informer is running.
+func celVariables(req *v1.AdmissionRequest, pod *corev1.Pod) (map[string]interface{}, error) {
+	vars := map[string]interface{}{
+		"object":          pod.DeepCopy(),
+		"oldObject":       nil,
+		"request":         nil,
+		"namespaceObject": nil,
+	}
+	if req != nil {
+		if len(req.OldObject.Raw) > 0 {
+			oldPod, _, err := decodePod(req.Resource, req.OldObject.Raw, webhook.Codecs().UniversalDeserializer())
+			if err != nil {
+				return nil, err
+			}
+			vars["oldObject"] = oldPod
+		}
+		// the objects are already available as variables
+		request := req.DeepCopy()
+		request.Object, request.OldObject = runtime.RawExtension{}, runtime.RawExtension{}
+		vars["request"] = request
+	}
+	if namespaceLister != nil && pod.Namespace != "" {
+		ns, err := namespaceLister.Get(pod.Namespace)
+		if err != nil {
+			klog.Errorf("failed to get namespace %s, namespaceObject is null: %v", pod.Namespace, err)
+		} else {
+			vars["namespaceObject"] = ns.DeepCopy()
+		}
+	}
+	return vars, nil
+}
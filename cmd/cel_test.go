@@ -0,0 +1,274 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/warpcomdev/think8shook/internal/webhook"
+	v1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const testCELPolicy = `
+apiVersion: think8shook.io/v1alpha1
+kind: HardeningPolicy
+spec:
+  runAsUser: 2000
+  mutations:
+  - name: namespace-uid
+    match:
+      expression: request.userInfo.username != "admin"
+    actions:
+    - setIfAbsent:
+        field: spec.securityContext.runAsUser
+        valueFrom:
+          expression: int(namespaceObject.metadata.annotations["example.com/uid"])
+          policy: runAsUser
+  - name: payments
+    match:
+      expression: >-
+        has(namespaceObject.metadata.labels) &&
+        namespaceObject.metadata.labels["team"] == "payments"
+    actions:
+    - addLabel:
+        key: team
+        value: payments
+  - name: immutable-debug
+    match:
+      expression: >-
+        oldObject != null &&
+        size(object.spec.ephemeralContainers) > (has(oldObject.spec.ephemeralContainers) ? size(oldObject.spec.ephemeralContainers) : 0)
+    builtin: drop-capabilities
+`
+
+func TestCELMutations(t *testing.T) {
+	cfg, err := loadTestPolicy(t, testCELPolicy)
+	require.NoError(t, err)
+	defer func() { policy = defaultPolicyConfig() }()
+	policy = cfg
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	require.NoError(t, indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "payments",
+		Labels:      map[string]string{"team": "payments"},
+		Annotations: map[string]string{"example.com/uid": "5000"},
+	}}))
+	require.NoError(t, indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}))
+	namespaceLister = corelisters.NewNamespaceLister(indexer)
+	defer func() { namespaceLister = nil }()
+
+	debug := corev1.EphemeralContainer{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Image: "busybox"}}
+	testCases := []struct {
+		name      string
+		namespace string
+		user      string
+		oldPod    *corev1.Pod
+		uid       *int64
+		labels    map[string]string
+		applied   string
+	}{
+		{
+			name:      "uid from the namespace annotation",
+			namespace: "payments",
+			user:      "alice",
+			uid:       &[]int64{5000}[0],
+			labels:    map[string]string{"team": "payments"},
+			applied:   "namespace-uid,payments",
+		},
+		{
+			name:      "uid from the policy",
+			namespace: "default",
+			user:      "alice",
+			uid:       &[]int64{2000}[0],
+			applied:   "namespace-uid",
+		},
+		{
+			name:      "request not matched",
+			namespace: "default",
+			user:      "admin",
+		},
+		{
+			name:      "old object",
+			namespace: "default",
+			user:      "admin",
+			oldPod:    &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}}},
+			applied:   "immutable-debug",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: tc.namespace},
+				Spec: corev1.PodSpec{
+					Containers:          []corev1.Container{{Name: "app", Image: "nginx", SecurityContext: &corev1.SecurityContext{Capabilities: &corev1.Capabilities{}}}},
+					EphemeralContainers: []corev1.EphemeralContainer{debug},
+				},
+			}
+			req := &v1.AdmissionRequest{
+				Resource:  podsResource,
+				Namespace: tc.namespace,
+				Operation: v1.Create,
+				UserInfo:  authenticationv1.UserInfo{Username: tc.user},
+			}
+			if tc.oldPod != nil {
+				req.Operation = v1.Update
+				req.OldObject = runtime.RawExtension{Raw: mustMarshal(tc.oldPod)}
+			}
+			raw := mustMarshal(pod)
+			ps := &patchSet{}
+			require.NoError(t, mutateRules(req, pod, ps))
+			require.Equal(t, tc.applied, ps.auditAnnotations()[rulesAuditKey])
+			mutated := mustApply(t, raw, ps)
+			if tc.uid == nil {
+				require.Nil(t, mutated.Spec.SecurityContext)
+			} else {
+				require.Equal(t, tc.uid, mutated.Spec.SecurityContext.RunAsUser)
+			}
+			require.Equal(t, tc.labels, mutated.Labels)
+		})
+	}
+}
+
+func TestCELCompileErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		mutation string
+		err      string
+	}{
+		{
+			name:     "syntax error",
+			mutation: "{name: test, match: {expression: 'object.metadata.name =='}, builtin: drop-capabilities}",
+			err:      "invalid expression",
+		},
+		{
+			name:     "undeclared variable",
+			mutation: "{name: test, match: {expression: 'pod.metadata.name == \"a\"'}, builtin: drop-capabilities}",
+			err:      "undeclared reference to 'pod'",
+		},
+		{
+			name:     "condition not bool",
+			mutation: "{name: test, match: {expression: 'size(object.spec.containers) + 1'}, builtin: drop-capabilities}",
+			err:      "must return bool, returns int",
+		},
+		{
+			name:     "value of another type",
+			mutation: "{name: test, actions: [{setIfAbsent: {field: spec.securityContext.runAsUser, valueFrom: {expression: 'object.metadata.name + \"-uid\"'}}}]}",
+			err:      "returns string",
+		},
+		{
+			name:     "annotation into an int field",
+			mutation: "{name: test, actions: [{setIfAbsent: {field: spec.securityContext.runAsUser, valueFrom: {expression: 'namespaceObject.metadata.annotations[\"uid\"]'}}}]}",
+			err:      "returns string",
+		},
+		{
+			name:     "unknown object field",
+			mutation: "{name: test, match: {expression: 'object.metadata.nme == \"a\"'}, builtin: drop-capabilities}",
+			err:      "undefined field 'nme'",
+		},
+		{
+			name:     "invalid failure policy",
+			mutation: "{name: test, failurePolicy: Retry, builtin: drop-capabilities}",
+			err:      `unsupported failurePolicy "Retry"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			content := "apiVersion: think8shook.io/v1alpha1\nkind: HardeningPolicy\nspec:\n  mutations:\n  - " + tc.mutation + "\n"
+			_, err := loadTestPolicy(t, content)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestCELFailurePolicy(t *testing.T) {
+	defer func() { policy = defaultPolicyConfig() }()
+	privileged := true
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:            "app",
+			Image:           "nginx",
+			SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+		}}},
+	}
+	// The security context of the container is not a valid seccomp profile,
+	// and namespaceObject is null without the namespace informer
+	mutations := func(failurePolicy string) string {
+		return `
+apiVersion: think8shook.io/v1alpha1
+kind: HardeningPolicy
+spec:
+  mutations:
+  - name: seccomp
+    failurePolicy: ` + failurePolicy + `
+    actions:
+    - setIfAbsent:
+        field: spec.securityContext.seccompProfile
+        valueFrom:
+          expression: object.spec.containers[0].securityContext
+          policy: seccompProfile
+  - name: namespace
+    failurePolicy: ` + failurePolicy + `
+    match:
+      expression: namespaceObject.metadata.name == "default"
+    builtin: drop-capabilities
+  - name: remove-privileged
+    builtin: remove-privileged
+`
+	}
+
+	// Ignore counts the errors and applies the other rules and sources
+	cfg, err := loadTestPolicy(t, mutations("Ignore"))
+	require.NoError(t, err)
+	policy = cfg
+	valueErrors := testutil.ToFloat64(ruleExpressionErrors.WithLabelValues("seccomp", "value"))
+	matchErrors := testutil.ToFloat64(ruleExpressionErrors.WithLabelValues("namespace", "match"))
+	raw := mustMarshal(pod)
+	ps := &patchSet{}
+	require.NoError(t, mutateRules(&v1.AdmissionRequest{Namespace: "default"}, pod.DeepCopy(), ps))
+	require.Equal(t, "seccomp,remove-privileged", ps.auditAnnotations()[rulesAuditKey])
+	mutated := mustApply(t, raw, ps)
+	require.Equal(t, &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}, mutated.Spec.SecurityContext.SeccompProfile)
+	require.Equal(t, valueErrors+1, testutil.ToFloat64(ruleExpressionErrors.WithLabelValues("seccomp", "value")))
+	require.Equal(t, matchErrors+1, testutil.ToFloat64(ruleExpressionErrors.WithLabelValues("namespace", "match")))
+
+	// Fail rejects the pod instead of admitting it without hardening
+	cfg, err = loadTestPolicy(t, mutations("Fail"))
+	require.NoError(t, err)
+	policy = cfg
+	policy.DisabledRules = []string{"namespace"}
+	err = mutateRules(&v1.AdmissionRequest{Namespace: "default"}, pod.DeepCopy(), &patchSet{})
+	require.ErrorContains(t, err, "rule seccomp")
+	policy.DisabledRules = nil
+	response := mutateSecurityContext(v1.AdmissionReview{Request: &v1.AdmissionRequest{
+		Resource:  podsResource,
+		Namespace: "default",
+		Operation: v1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}}, webhook.Codecs())
+	require.False(t, response.Allowed)
+	require.Contains(t, response.Result.Message, "rule namespace")
+	require.Nil(t, response.Patch)
+}
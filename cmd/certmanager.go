@@ -0,0 +1,339 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+// Keys of the CA in the self-managed certificate Secret. The serving
+// certificate uses the standard kubernetes.io/tls keys. The previous
+// CA is kept trusted for a while after a rotation.
+const (
+	caCertKey    = "ca.crt"
+	caKeyKey     = "ca.key"
+	caOldCertKey = "ca.crt.old"
+)
+
+// Default lifetimes of the self-managed certificates
+const (
+	defaultCAValidity      = 10 * 365 * 24 * time.Hour
+	defaultServingValidity = 365 * 24 * time.Hour
+	defaultRenewBefore     = 30 * 24 * time.Hour
+	defaultCheckInterval   = time.Hour
+)
+
+// certManager keeps a CA and serving certificate in a Secret, shared by all
+// the replicas, renews them before they expire and injects the CA bundle
+// in the webhook configurations
+type certManager struct {
+	client     kubernetes.Interface
+	namespace  string
+	secretName string
+	dnsNames   []string
+	// Names of the webhook configurations to inject the CA bundle into, if any
+	mutatingWebhookConfig   string
+	validatingWebhookConfig string
+
+	caValidity      time.Duration
+	servingValidity time.Duration
+	renewBefore     time.Duration
+	checkInterval   time.Duration
+	now             func() time.Time
+
+	current atomic.Pointer[tls.Certificate]
+}
+
+func newCertManager(client kubernetes.Interface, namespace, secretName string, dnsNames []string) *certManager {
+	return &certManager{
+		client:          client,
+		namespace:       namespace,
+		secretName:      secretName,
+		dnsNames:        dnsNames,
+		caValidity:      defaultCAValidity,
+		servingValidity: defaultServingValidity,
+		renewBefore:     defaultRenewBefore,
+		checkInterval:   defaultCheckInterval,
+		now:             time.Now,
+	}
+}
+
+// serviceDNSNames returns the names a service is reachable at from the API server
+func serviceDNSNames(namespace, name string) []string {
+	return []string{
+		name,
+		fmt.Sprintf("%s.%s", name, namespace),
+		fmt.Sprintf("%s.%s.svc", name, namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", name, namespace),
+	}
+}
+
+// GetCertificate returns the current serving certificate, for tls.Config
+func (m *certManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := m.current.Load()
+	if cert == nil {
+		return nil, fmt.Errorf("serving certificate not available yet")
+	}
+	return cert, nil
+}
+
+// ensure makes sure the Secret holds valid certificates, serves them
+// and injects the CA in the webhook configurations. Retries when
+// other replicas update the Secret concurrently.
+func (m *certManager) ensure(ctx context.Context) error {
+	err := retry.OnError(retry.DefaultBackoff, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		return m.ensureSecret(ctx)
+	})
+	if err != nil {
+		certificateReloads.WithLabelValues("error").Inc()
+		return fmt.Errorf("failed to ensure certificate secret %s/%s: %w", m.namespace, m.secretName, err)
+	}
+	return nil
+}
+
+// ensureSecret creates or renews the certificates in the Secret
+func (m *certManager) ensureSecret(ctx context.Context) error {
+	secret, err := m.client.CoreV1().Secrets(m.namespace).Get(ctx, m.secretName, metav1.GetOptions{})
+	create := apierrors.IsNotFound(err)
+	if create {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: m.namespace, Name: m.secretName},
+			Type:       corev1.SecretTypeTLS,
+		}
+	} else if err != nil {
+		return err
+	}
+	data := make(map[string][]byte, 4)
+	for key, value := range secret.Data {
+		data[key] = value
+	}
+	renewed, err := m.renew(data)
+	if err != nil {
+		return err
+	}
+	if renewed {
+		secret = secret.DeepCopy()
+		secret.Data = data
+		if create {
+			_, err = m.client.CoreV1().Secrets(m.namespace).Create(ctx, secret, metav1.CreateOptions{})
+		} else {
+			_, err = m.client.CoreV1().Secrets(m.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			return err
+		}
+		klog.Infof("renewed certificates in secret %s/%s", m.namespace, m.secretName)
+	}
+	if err := m.serve(data); err != nil {
+		return err
+	}
+	return m.injectCABundle(ctx, caBundle(data))
+}
+
+// caBundle returns the CA certificates to trust: the current one, and
+// the previous one while the serving certificates are being rotated
+func caBundle(data map[string][]byte) []byte {
+	if len(data[caOldCertKey]) == 0 {
+		return data[caCertKey]
+	}
+	return bytes.Join([][]byte{data[caCertKey], data[caOldCertKey]}, nil)
+}
+
+// renew regenerates the certificates in data that are missing, invalid
+// or about to expire. Returns true if data was modified.
+//
+// When the CA is rotated, the previous one is kept in the bundle and the
+// serving certificate is not re-signed until one check interval later,
+// so that the new CA is trusted by then. The previous CA is dropped one
+// more interval later, once every replica serves a re-signed certificate.
+func (m *certManager) renew(data map[string][]byte) (bool, error) {
+	now := m.now()
+	renewed := false
+	ca, err := parseCertificate(data[caCertKey])
+	if err == nil {
+		_, err = parsePrivateKey(data[caKeyKey])
+	}
+	if err != nil || now.Add(m.renewBefore).After(ca.NotAfter) {
+		if err == nil && now.Before(ca.NotAfter) {
+			data[caOldCertKey] = data[caCertKey]
+		} else {
+			delete(data, caOldCertKey)
+		}
+		caCert, caKey, err := generateCA(fmt.Sprintf("%s-ca", m.secretName), now, m.caValidity)
+		if err != nil {
+			return false, err
+		}
+		data[caCertKey], data[caKeyKey] = caCert, caKey
+		if ca, err = parseCertificate(caCert); err != nil {
+			return false, err
+		}
+		renewed = true
+	}
+	signers := []*x509.Certificate{ca}
+	if _, found := data[caOldCertKey]; found {
+		// generateCA backdates the certificate
+		rotated := ca.NotBefore.Add(certBackdate)
+		old, err := parseCertificate(data[caOldCertKey])
+		switch {
+		case err != nil || !now.Before(old.NotAfter):
+			delete(data, caOldCertKey)
+			renewed = true
+		case now.Before(rotated.Add(m.checkInterval)):
+			signers = append(signers, old)
+		case !now.Before(rotated.Add(2*m.checkInterval)) && m.validServingCert(data, signers, now):
+			delete(data, caOldCertKey)
+			renewed = true
+		}
+	}
+	if !m.validServingCert(data, signers, now) {
+		cert, key, err := generateServingCert(data[caCertKey], data[caKeyKey], m.dnsNames, now, m.servingValidity)
+		if err != nil {
+			return false, err
+		}
+		data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey] = cert, key
+		renewed = true
+	}
+	return renewed, nil
+}
+
+// validServingCert returns true if the serving certificate in data is signed
+// by any of the signers, matches the DNS names and is not about to expire
+func (m *certManager) validServingCert(data map[string][]byte, signers []*x509.Certificate, now time.Time) bool {
+	pair, err := tls.X509KeyPair(data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return false
+	}
+	cert := pair.Leaf
+	if !slices.ContainsFunc(signers, func(ca *x509.Certificate) bool { return cert.CheckSignatureFrom(ca) == nil }) {
+		return false
+	}
+	if !slices.Equal(cert.DNSNames, m.dnsNames) {
+		return false
+	}
+	return now.Add(m.renewBefore).Before(cert.NotAfter)
+}
+
+// serve replaces the current serving certificate with the one in data
+func (m *certManager) serve(data map[string][]byte) error {
+	pair, err := tls.X509KeyPair(data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return err
+	}
+	if current := m.current.Load(); current != nil && bytes.Equal(current.Certificate[0], pair.Certificate[0]) {
+		return nil
+	}
+	m.current.Store(&pair)
+	certificateReloads.WithLabelValues("success").Inc()
+	certificateExpiry.Set(float64(pair.Leaf.NotAfter.Unix()))
+	klog.Infof("serving certificate from secret %s/%s, valid until %s", m.namespace, m.secretName, pair.Leaf.NotAfter)
+	return nil
+}
+
+// injectCABundle sets the caBundle of every webhook in the configured
+// webhook configurations
+func (m *certManager) injectCABundle(ctx context.Context, caBundle []byte) error {
+	if m.mutatingWebhookConfig != "" {
+		err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+			client := m.client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+			config, err := client.Get(ctx, m.mutatingWebhookConfig, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			clientConfigs := make([]*admissionregistrationv1.WebhookClientConfig, 0, len(config.Webhooks))
+			for idx := range config.Webhooks {
+				clientConfigs = append(clientConfigs, &config.Webhooks[idx].ClientConfig)
+			}
+			if !setCABundle(clientConfigs, caBundle) {
+				return nil
+			}
+			_, err = client.Update(ctx, config, metav1.UpdateOptions{})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to inject CA bundle in MutatingWebhookConfiguration %s: %w", m.mutatingWebhookConfig, err)
+		}
+	}
+	if m.validatingWebhookConfig != "" {
+		err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+			client := m.client.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+			config, err := client.Get(ctx, m.validatingWebhookConfig, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			clientConfigs := make([]*admissionregistrationv1.WebhookClientConfig, 0, len(config.Webhooks))
+			for idx := range config.Webhooks {
+				clientConfigs = append(clientConfigs, &config.Webhooks[idx].ClientConfig)
+			}
+			if !setCABundle(clientConfigs, caBundle) {
+				return nil
+			}
+			_, err = client.Update(ctx, config, metav1.UpdateOptions{})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to inject CA bundle in ValidatingWebhookConfiguration %s: %w", m.validatingWebhookConfig, err)
+		}
+	}
+	return nil
+}
+
+// setCABundle sets caBundle in every client config. Returns true
+// if any of them was changed.
+func setCABundle(clientConfigs []*admissionregistrationv1.WebhookClientConfig, caBundle []byte) bool {
+	changed := false
+	for _, clientConfig := range clientConfigs {
+		if !bytes.Equal(clientConfig.CABundle, caBundle) {
+			clientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Start checks the certificates periodically until ctx is done, so that they
+// are renewed before expiring and replicas pick up the renewals of others
+func (m *certManager) Start(ctx context.Context) {
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.ensure(ctx); err != nil {
+				klog.Error(err)
+			}
+		}
+	}
+}
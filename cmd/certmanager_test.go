@@ -0,0 +1,156 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCertManager(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "think8shook"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{Name: "pods.think8shook.io"},
+			{Name: "workloads.think8shook.io"},
+		},
+	}, &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "think8shook"},
+		Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "pods.think8shook.io"}},
+	})
+	now := time.Now()
+	manager := newCertManager(client, "think8shook", "think8shook-certs", serviceDNSNames("think8shook", "webhook"))
+	manager.mutatingWebhookConfig = "think8shook"
+	manager.validatingWebhookConfig = "think8shook"
+	manager.now = func() time.Time { return now }
+
+	// Certificates are created on first run
+	require.NoError(t, manager.ensure(ctx))
+	secret, err := client.CoreV1().Secrets("think8shook").Get(ctx, "think8shook-certs", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, corev1.SecretTypeTLS, secret.Type)
+	ca, err := parseCertificate(secret.Data[caCertKey])
+	require.NoError(t, err)
+	serving, err := manager.GetCertificate(nil)
+	require.NoError(t, err)
+	require.NoError(t, serving.Leaf.CheckSignatureFrom(ca))
+	_, err = serving.Leaf.Verify(x509.VerifyOptions{
+		DNSName:     "webhook.think8shook.svc",
+		Roots:       func() *x509.CertPool { pool := x509.NewCertPool(); pool.AddCert(ca); return pool }(),
+		CurrentTime: now,
+	})
+	require.NoError(t, err)
+
+	// The CA bundle is injected in every webhook
+	mutating, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "think8shook", metav1.GetOptions{})
+	require.NoError(t, err)
+	for _, webhook := range mutating.Webhooks {
+		require.Equal(t, secret.Data[caCertKey], webhook.ClientConfig.CABundle)
+	}
+	validating, err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, "think8shook", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, secret.Data[caCertKey], validating.Webhooks[0].ClientConfig.CABundle)
+
+	// Valid certificates are reused, as other replicas would do
+	replica := newCertManager(client, "think8shook", "think8shook-certs", serviceDNSNames("think8shook", "webhook"))
+	replica.now = manager.now
+	client.ClearActions()
+	require.NoError(t, replica.ensure(ctx))
+	for _, action := range client.Actions() {
+		require.Equal(t, "get", action.GetVerb())
+	}
+	replicaServing, err := replica.GetCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, serving.Certificate, replicaServing.Certificate)
+
+	// The serving certificate is renewed before expiry, keeping the CA
+	now = now.Add(defaultServingValidity - defaultRenewBefore/2)
+	require.NoError(t, manager.ensure(ctx))
+	renewed, err := manager.GetCertificate(nil)
+	require.NoError(t, err)
+	require.NotEqual(t, serving.Leaf.SerialNumber, renewed.Leaf.SerialNumber)
+	require.NoError(t, renewed.Leaf.CheckSignatureFrom(ca))
+	secret, err = client.CoreV1().Secrets("think8shook").Get(ctx, "think8shook-certs", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, renewed.Certificate[0], func() []byte {
+		cert, err := parseCertificate(secret.Data[corev1.TLSCertKey])
+		require.NoError(t, err)
+		return cert.Raw
+	}())
+
+	// The CA is renewed before expiry, and injected along with the previous one
+	now = ca.NotAfter.Add(-defaultRenewBefore - 24*time.Hour)
+	require.NoError(t, manager.ensure(ctx))
+	previous, err := manager.GetCertificate(nil)
+	require.NoError(t, err)
+	require.NoError(t, previous.Leaf.CheckSignatureFrom(ca))
+	now = now.Add(48 * time.Hour)
+	require.NoError(t, manager.ensure(ctx))
+	secret, err = client.CoreV1().Secrets("think8shook").Get(ctx, "think8shook-certs", metav1.GetOptions{})
+	require.NoError(t, err)
+	newCA, err := parseCertificate(secret.Data[caCertKey])
+	require.NoError(t, err)
+	require.NotEqual(t, ca.SerialNumber, newCA.SerialNumber)
+	require.Equal(t, ca.Raw, func() []byte {
+		cert, err := parseCertificate(secret.Data[caOldCertKey])
+		require.NoError(t, err)
+		return cert.Raw
+	}())
+	mutating, err = client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "think8shook", metav1.GetOptions{})
+	require.NoError(t, err)
+	bundle := append(append([]byte{}, secret.Data[caCertKey]...), secret.Data[caOldCertKey]...)
+	require.Equal(t, bundle, mutating.Webhooks[0].ClientConfig.CABundle)
+
+	// The serving certificate is not re-signed until the new CA is trusted
+	current, err := manager.GetCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, previous.Certificate, current.Certificate)
+	now = now.Add(defaultCheckInterval / 2)
+	require.NoError(t, manager.ensure(ctx))
+	current, err = manager.GetCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, previous.Certificate, current.Certificate)
+
+	// One check interval later it is re-signed by the new CA, still trusting the old one
+	now = now.Add(defaultCheckInterval / 2)
+	require.NoError(t, manager.ensure(ctx))
+	current, err = manager.GetCertificate(nil)
+	require.NoError(t, err)
+	require.NoError(t, current.Leaf.CheckSignatureFrom(newCA))
+	secret, err = client.CoreV1().Secrets("think8shook").Get(ctx, "think8shook-certs", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Contains(t, secret.Data, caOldCertKey)
+
+	// The old CA is dropped after another interval
+	now = now.Add(defaultCheckInterval)
+	require.NoError(t, manager.ensure(ctx))
+	secret, err = client.CoreV1().Secrets("think8shook").Get(ctx, "think8shook-certs", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.NotContains(t, secret.Data, caOldCertKey)
+	mutating, err = client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "think8shook", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, secret.Data[caCertKey], mutating.Webhooks[0].ClientConfig.CABundle)
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/klog/v2"
+)
+
+// certReloadDelay lets a burst of file changes settle before reloading
+const certReloadDelay = 100 * time.Millisecond
+
+// certWatcher serves the key pair in certFile and keyFile, reloading it
+// whenever the files change
+type certWatcher struct {
+	certFile string
+	keyFile  string
+	current  atomic.Pointer[tls.Certificate]
+}
+
+// newCertWatcher loads the initial key pair. Fails if it cannot be read.
+func newCertWatcher(certFile, keyFile string) (*certWatcher, error) {
+	watcher := &certWatcher{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := watcher.reload(); err != nil {
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// GetCertificate returns the current key pair, for tls.Config
+func (w *certWatcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return w.current.Load(), nil
+}
+
+// reload reads the key pair from disk. The previous pair is kept
+// if the new one cannot be loaded.
+func (w *certWatcher) reload() error {
+	cert, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+	if err == nil && cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if err != nil {
+		certificateReloads.WithLabelValues("error").Inc()
+		return fmt.Errorf("failed to load key pair %s, %s: %w", w.certFile, w.keyFile, err)
+	}
+	w.current.Store(&cert)
+	certificateReloads.WithLabelValues("success").Inc()
+	certificateExpiry.Set(float64(cert.Leaf.NotAfter.Unix()))
+	return nil
+}
+
+// Start watches the directories holding the key pair until ctx is done.
+// Directories are watched instead of files because Kubernetes updates
+// mounted secrets by swapping a symlink, which file watches miss.
+func (w *certWatcher) Start(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	for _, dir := range []string{filepath.Dir(w.certFile), filepath.Dir(w.keyFile)} {
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+	}
+	reload := time.NewTimer(certReloadDelay)
+	reload.Stop()
+	defer reload.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			// Chmod is reported on every access by some tools
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			klog.V(2).Infof("certificate directory changed: %s", event)
+			reload.Reset(certReloadDelay)
+		case <-reload.C:
+			if err := w.reload(); err != nil {
+				klog.Errorf("keeping the previous certificate: %v", err)
+				continue
+			}
+			klog.Infof("reloaded certificate %s, valid until %s", w.certFile, w.current.Load().Leaf.NotAfter)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			klog.Errorf("certificate watcher error: %v", err)
+		}
+	}
+}
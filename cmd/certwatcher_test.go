@@ -0,0 +1,105 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// writeKeyPair writes a self-signed key pair for commonName in dir
+func writeKeyPair(t *testing.T, dir, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tls.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tls.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+}
+
+// swapSecretDir mimics the kubelet updating a mounted secret: files are
+// written to a new directory and the ..data symlink is atomically replaced
+func swapSecretDir(t *testing.T, dir, version string, write func(dataDir string)) {
+	dataDir := filepath.Join(dir, version)
+	require.NoError(t, os.Mkdir(dataDir, 0o700))
+	write(dataDir)
+	tmpLink := filepath.Join(dir, "..data_tmp")
+	require.NoError(t, os.Symlink(version, tmpLink))
+	require.NoError(t, os.Rename(tmpLink, filepath.Join(dir, "..data")))
+}
+
+func TestCertWatcher(t *testing.T) {
+	dir := t.TempDir()
+	swapSecretDir(t, dir, "..v1", func(dataDir string) { writeKeyPair(t, dataDir, "first") })
+	for _, name := range []string{"tls.crt", "tls.key"} {
+		require.NoError(t, os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name)))
+	}
+	watcher, err := newCertWatcher(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+	require.NoError(t, err)
+	commonName := func() string {
+		cert, err := watcher.GetCertificate(nil)
+		require.NoError(t, err)
+		return cert.Leaf.Subject.CommonName
+	}
+	require.Equal(t, "first", commonName())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- watcher.Start(ctx) }()
+	defer func() {
+		cancel()
+		require.NoError(t, <-done)
+	}()
+	// Give the watcher time to register the directories
+	time.Sleep(100 * time.Millisecond)
+
+	// A new pair is served once the symlink is swapped
+	swapSecretDir(t, dir, "..v2", func(dataDir string) { writeKeyPair(t, dataDir, "second") })
+	require.Eventually(t, func() bool { return commonName() == "second" }, 5*time.Second, 50*time.Millisecond)
+
+	// An invalid pair is reported and the previous one is kept
+	failures := testutil.ToFloat64(certificateReloads.WithLabelValues("error"))
+	swapSecretDir(t, dir, "..v3", func(dataDir string) {
+		require.NoError(t, os.WriteFile(filepath.Join(dataDir, "tls.crt"), []byte("invalid"), 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(dataDir, "tls.key"), []byte("invalid"), 0o600))
+	})
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(certificateReloads.WithLabelValues("error")) > failures
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, "second", commonName())
+}
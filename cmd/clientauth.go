@@ -0,0 +1,86 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+
+	"k8s.io/klog/v2"
+)
+
+// clientAuth rejects requests without a verified client certificate,
+// or whose certificate is not in the allowlist
+type clientAuth struct {
+	// allowedNames are matched against the subject common name and the
+	// DNS names of the client certificate. Any verified client is
+	// accepted if empty.
+	allowedNames []string
+}
+
+// loadClientCAs reads the PEM encoded CA certificates in file
+func loadClientCAs(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM encoded certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// reject returns the reason to reject the request, or an empty string
+// if the client is allowed
+func (a clientAuth) reject(r *http.Request) string {
+	if r.TLS == nil {
+		return "not a TLS connection"
+	}
+	if len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "no verified client certificate"
+	}
+	if len(a.allowedNames) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if slices.Contains(a.allowedNames, cert.Subject.CommonName) {
+		return ""
+	}
+	for _, name := range cert.DNSNames {
+		if slices.Contains(a.allowedNames, name) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("client certificate %q with DNS names %v is not allowed", cert.Subject.CommonName, cert.DNSNames)
+}
+
+// wrap rejects the requests not allowed before reaching the handler
+func (a clientAuth) wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reason := a.reject(r); reason != "" {
+			klog.Warningf("rejecting request from %s to %s: %s", r.RemoteAddr, r.URL.Path, reason)
+			clientAuthRejections.Inc()
+			http.Error(w, "client not allowed", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientAuth(t *testing.T) {
+	now := time.Now()
+	caCert, caKey, err := generateCA("clients", now, time.Hour)
+	require.NoError(t, err)
+	otherCACert, otherCAKey, err := generateCA("others", now, time.Hour)
+	require.NoError(t, err)
+	servingCert, servingKey, err := generateServingCert(caCert, caKey, []string{"localhost"}, now, time.Hour)
+	require.NoError(t, err)
+	serving, err := tls.X509KeyPair(servingCert, servingKey)
+	require.NoError(t, err)
+	clientCert := func(caCertPEM, caKeyPEM []byte, commonName string, dnsNames ...string) tls.Certificate {
+		ca, err := parseCertificate(caCertPEM)
+		require.NoError(t, err)
+		key, err := parsePrivateKey(caKeyPEM)
+		require.NoError(t, err)
+		certPEM, keyPEM, err := signCertificate(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: commonName},
+			DNSNames:    dnsNames,
+			NotBefore:   now.Add(-time.Minute),
+			NotAfter:    now.Add(time.Hour),
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, key)
+		require.NoError(t, err)
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		require.NoError(t, err)
+		return pair
+	}
+	pool, err := func() (*x509.CertPool, error) {
+		ca, err := parseCertificate(caCert)
+		pool := x509.NewCertPool()
+		pool.AddCert(ca)
+		return pool, err
+	}()
+	require.NoError(t, err)
+
+	auth := clientAuth{allowedNames: []string{"kube-apiserver", "apiserver.example.com"}}
+	server := httptest.NewUnstartedServer(auth.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serving},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	testCases := []struct {
+		name   string
+		certs  []tls.Certificate
+		status int
+	}{
+		{
+			name:   "no client certificate",
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "allowed common name",
+			certs:  []tls.Certificate{clientCert(caCert, caKey, "kube-apiserver")},
+			status: http.StatusOK,
+		},
+		{
+			name:   "allowed DNS name",
+			certs:  []tls.Certificate{clientCert(caCert, caKey, "apiserver", "apiserver.example.com")},
+			status: http.StatusOK,
+		},
+		{
+			name:   "common name not allowed",
+			certs:  []tls.Certificate{clientCert(caCert, caKey, "intruder")},
+			status: http.StatusForbidden,
+		},
+		{
+			// The client may not send a certificate the server does not accept
+			name:   "unknown CA",
+			certs:  []tls.Certificate{clientCert(otherCACert, otherCAKey, "kube-apiserver")},
+			status: http.StatusForbidden,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				Certificates:       tc.certs,
+				InsecureSkipVerify: true,
+			}}}
+			resp, err := client.Get(server.URL)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, tc.status, resp.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strings"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+)
+
+// admissionEndpoint is an admission webhook served by the hook
+type admissionEndpoint struct {
+	path     string
+	mutating bool
+	handler  func(codecs *serializer.CodecFactory) http.Handler
+	// rules the webhook configuration must match to send requests here
+	rules func() []admissionregistrationv1.RuleWithOperations
+}
+
+// admissionEndpoints lists the webhooks registered by the server, and
+// rendered by the manifests subcommand
+var admissionEndpoints = []admissionEndpoint{
+	{
+		path:     "/mutating-pods",
+		mutating: true,
+		handler:  serveMutatePods,
+		rules:    mutatingRules,
+	},
+	{
+		path:     "/validating-pods",
+		mutating: false,
+		handler:  serveValidatePods,
+		rules:    validatingRules,
+	},
+}
+
+// webhookName returns the name of the webhook in the webhook configuration
+func (e admissionEndpoint) webhookName() string {
+	return strings.TrimPrefix(e.path, "/") + ".think8shook.io"
+}
+
+// mutatingRules match every resource in podDecoders, and the
+// ephemeral containers subresource used by kubectl debug
+func mutatingRules() []admissionregistrationv1.RuleWithOperations {
+	var rules []admissionregistrationv1.RuleWithOperations
+	for resource := range podDecoders {
+		resources := []string{resource.Resource}
+		if resource == podsResource {
+			resources = append(resources, podsResource.Resource+"/"+ephemeralContainersSubresource)
+		}
+		rules = append(rules, admissionregistrationv1.RuleWithOperations{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{resource.Group},
+				APIVersions: []string{resource.Version},
+				Resources:   resources,
+			},
+		})
+	}
+	slices.SortFunc(rules, func(a, b admissionregistrationv1.RuleWithOperations) int {
+		return cmp.Or(
+			cmp.Compare(a.APIGroups[0], b.APIGroups[0]),
+			cmp.Compare(a.Resources[0], b.Resources[0]),
+		)
+	})
+	return rules
+}
+
+// validatingRules match the pods and the ephemeral containers
+// subresource, the only updates that are validated
+func validatingRules() []admissionregistrationv1.RuleWithOperations {
+	return []admissionregistrationv1.RuleWithOperations{
+		{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{podsResource.Group},
+				APIVersions: []string{podsResource.Version},
+				Resources:   []string{podsResource.Resource},
+			},
+		},
+		{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Update},
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{podsResource.Group},
+				APIVersions: []string{podsResource.Version},
+				Resources:   []string{podsResource.Resource + "/" + ephemeralContainersSubresource},
+			},
+		},
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// exemptionConfig lists the pods that must not be mutated nor validated
+type exemptionConfig struct {
+	// NamespaceLabels exempt pods in namespaces with any of these labels.
+	// Only checked with --namespace-exemptions, which starts the namespace
+	// informer.
+	NamespaceLabels map[string]string `json:"namespaceLabels,omitempty"`
+	// PodLabels exempt pods with any of these labels. Pods can set their
+	// own labels, so NamespaceLabels should be preferred.
+	PodLabels map[string]string `json:"podLabels,omitempty"`
+	// ServiceAccounts exempt pods running with any of these service accounts,
+	// in "namespace/name" format. The name can be "*" to match all accounts.
+	ServiceAccounts []string `json:"serviceAccounts,omitempty"`
+	// Users exempt requests made by any of these users
+	Users []string `json:"users,omitempty"`
+	// Groups exempt requests made by members of any of these groups
+	Groups []string `json:"groups,omitempty"`
+	// Images exempt pods whose images all match any of these patterns.
+	// "*" in a pattern matches any sequence of characters.
+	Images []imagePattern `json:"images,omitempty"`
+}
+
+// defaultExemptionConfig skips pods in namespaces labeled with the
+// privileged Pod Security Standard. The label is not checked on the pod,
+// since pods could exempt themselves.
+func defaultExemptionConfig() exemptionConfig {
+	return exemptionConfig{
+		NamespaceLabels: map[string]string{
+			"pod-security.kubernetes.io/enforce": "privileged",
+		},
+	}
+}
+
+// UnmarshalJSON replaces the whole config instead of merging with the
+// defaults, so that the default exemptions can be removed.
+func (cfg *exemptionConfig) UnmarshalJSON(data []byte) error {
+	type plain exemptionConfig
+	var decoded plain
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&decoded); err != nil {
+		return err
+	}
+	*cfg = exemptionConfig(decoded)
+	return nil
+}
+
+// validate checks the exemption config is consistent
+func (cfg exemptionConfig) validate() error {
+	var errs []error
+	for _, sa := range cfg.ServiceAccounts {
+		if namespace, name, found := strings.Cut(sa, "/"); !found || namespace == "" || name == "" {
+			errs = append(errs, fmt.Errorf("exempted service account %q must have format namespace/name", sa))
+		}
+	}
+	for _, image := range cfg.Images {
+		if image.pattern == "" {
+			errs = append(errs, errors.New("exempted image pattern must not be empty"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// exemptionRule returns a description of the first exemption rule that
+// matches the request, or an empty string if the pod is not exempt
+func (cfg exemptionConfig) exemptionRule(req *v1.AdmissionRequest, pod *corev1.Pod) string {
+	if label, ok := matchLabels(cfg.PodLabels, pod.Labels); ok {
+		return fmt.Sprintf("podLabel %s", label)
+	}
+	if len(cfg.NamespaceLabels) > 0 && namespaceExemptions && namespaceLister != nil && pod.Namespace != "" {
+		ns, err := namespaceLister.Get(pod.Namespace)
+		if err != nil {
+			klog.Errorf("failed to get namespace %s, namespace exemptions not checked: %v", pod.Namespace, err)
+		} else if label, ok := matchLabels(cfg.NamespaceLabels, ns.Labels); ok {
+			return fmt.Sprintf("namespaceLabel %s", label)
+		}
+	}
+	if len(cfg.ServiceAccounts) > 0 {
+		name := pod.Spec.ServiceAccountName
+		if name == "" {
+			name = "default"
+		}
+		for _, sa := range cfg.ServiceAccounts {
+			if sa == pod.Namespace+"/"+name || sa == pod.Namespace+"/*" {
+				return fmt.Sprintf("serviceAccount %s", sa)
+			}
+		}
+	}
+	if req != nil {
+		if slices.Contains(cfg.Users, req.UserInfo.Username) {
+			return fmt.Sprintf("user %s", req.UserInfo.Username)
+		}
+		for _, group := range req.UserInfo.Groups {
+			if slices.Contains(cfg.Groups, group) {
+				return fmt.Sprintf("group %s", group)
+			}
+		}
+	}
+	if len(cfg.Images) > 0 {
+		if pattern, ok := matchImages(cfg.Images, pod); ok {
+			return fmt.Sprintf("image %s", pattern)
+		}
+	}
+	return ""
+}
+
+// matchLabels returns the first label in selector that is present in labels
+func matchLabels(selector, labels map[string]string) (string, bool) {
+	for _, key := range slices.Sorted(maps.Keys(selector)) {
+		value := selector[key]
+		if current, ok := labels[key]; ok && current == value {
+			return fmt.Sprintf("%s=%s", key, value), true
+		}
+	}
+	return "", false
+}
+
+// matchImages returns the matched patterns if all the images in the pod match
+// any of them. Any non-matching container would otherwise escape hardening.
+func matchImages(patterns []imagePattern, pod *corev1.Pod) (string, bool) {
+	images := podImages(pod)
+	if len(images) == 0 {
+		return "", false
+	}
+	matched := make([]string, 0, len(patterns))
+	for _, image := range images {
+		found := false
+		for _, pattern := range patterns {
+			if pattern.match(image) {
+				found = true
+				if !slices.Contains(matched, pattern.pattern) {
+					matched = append(matched, pattern.pattern)
+				}
+				break
+			}
+		}
+		if !found {
+			return "", false
+		}
+	}
+	return strings.Join(matched, ","), true
+}
+
+// podImages returns the images of all the containers in the pod
+func podImages(pod *corev1.Pod) []string {
+	images := make([]string, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers)+len(pod.Spec.EphemeralContainers))
+	for _, container := range pod.Spec.InitContainers {
+		images = append(images, container.Image)
+	}
+	for _, container := range pod.Spec.Containers {
+		images = append(images, container.Image)
+	}
+	for _, container := range pod.Spec.EphemeralContainers {
+		images = append(images, container.Image)
+	}
+	return images
+}
+
+// imagePattern is an image name where "*" matches any sequence of
+// characters, including "/". It is compiled once, when decoded.
+type imagePattern struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+func newImagePattern(pattern string) imagePattern {
+	parts := strings.Split(pattern, "*")
+	for idx, part := range parts {
+		parts[idx] = regexp.QuoteMeta(part)
+	}
+	// quoted parts always compile
+	re := regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+	return imagePattern{pattern: pattern, re: re}
+}
+
+// match returns true if the image matches the pattern
+func (p imagePattern) match(image string) bool {
+	return p.re != nil && p.re.MatchString(image)
+}
+
+func (p imagePattern) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.pattern)
+}
+
+func (p *imagePattern) UnmarshalJSON(data []byte) error {
+	var pattern string
+	if err := json.Unmarshal(data, &pattern); err != nil {
+		return err
+	}
+	*p = newImagePattern(pattern)
+	return nil
+}
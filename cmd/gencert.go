@@ -0,0 +1,100 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// gencertOptions are the flags of the gencert subcommand
+type gencertOptions struct {
+	service  string
+	caFile   string
+	validity time.Duration
+	caBundle bool
+}
+
+var gencertFlags gencertOptions
+
+// CmdGencert generates a self-signed certificate for the webhook
+var CmdGencert = &cobra.Command{
+	Use:   "gencert",
+	Short: "Generates a CA and a serving certificate for the webhook service",
+	Long: `Generates a CA and a serving certificate for the webhook service, valid for all the
+DNS names the API server may use to reach it. The serving certificate and key are written
+to --tls-cert-file and --tls-private-key-file, and the CA to --ca-file.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return gencertFlags.run(certFile, keyFile, cmd.OutOrStdout())
+	},
+}
+
+func init() {
+	CmdGencert.Flags().StringVar(&gencertFlags.service, "service", "",
+		"Service fronting the webhook, as namespace/name.")
+	CmdGencert.Flags().StringVar(&gencertFlags.caFile, "ca-file", "",
+		"File to write the CA certificate to.")
+	CmdGencert.Flags().DurationVar(&gencertFlags.validity, "validity", defaultServingValidity,
+		"Validity of the CA and serving certificates.")
+	CmdGencert.Flags().BoolVar(&gencertFlags.caBundle, "print-ca-bundle", false,
+		"Print the base64 encoded CA bundle, to paste as caBundle in the webhook configuration.")
+	CmdGencert.MarkFlagRequired("service")
+	CmdWebhook.AddCommand(CmdGencert)
+}
+
+// run generates the certificates and writes them to the given files
+func (o gencertOptions) run(certFile, keyFile string, out io.Writer) error {
+	if certFile == "" || keyFile == "" {
+		return errors.New("--tls-cert-file and --tls-private-key-file are required")
+	}
+	namespace, name, err := splitNamespacedName("service", o.service)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	caCert, caKey, err := generateCA(fmt.Sprintf("%s-ca", name), now, o.validity)
+	if err != nil {
+		return err
+	}
+	cert, key, err := generateServingCert(caCert, caKey, serviceDNSNames(namespace, name), now, o.validity)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, cert, 0o644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, key, 0o600); err != nil {
+		return err
+	}
+	if o.caFile != "" {
+		if err := os.WriteFile(o.caFile, caCert, 0o644); err != nil {
+			return err
+		}
+	}
+	if o.caBundle {
+		_, err := fmt.Fprintln(out, base64.StdEncoding.EncodeToString(caCert))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGencert(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath, caPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	var out bytes.Buffer
+	opts := gencertOptions{
+		service:  "think8shook/webhook",
+		caFile:   caPath,
+		validity: time.Hour,
+		caBundle: true,
+	}
+	require.NoError(t, opts.run(certPath, keyPath, &out))
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	require.NoError(t, err)
+	caPEM, err := os.ReadFile(caPath)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(caPEM))
+	for _, name := range []string{"webhook", "webhook.think8shook", "webhook.think8shook.svc", "webhook.think8shook.svc.cluster.local"} {
+		_, err := pair.Leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots})
+		require.NoError(t, err, name)
+	}
+
+	// The CA bundle is the base64 encoded CA certificate
+	bundle, err := base64.StdEncoding.DecodeString(strings.TrimSpace(out.String()))
+	require.NoError(t, err)
+	require.Equal(t, caPEM, bundle)
+
+	opts.service = "webhook"
+	require.Error(t, opts.run(certPath, keyPath, &out))
+	require.Error(t, opts.run("", "", &out))
+}
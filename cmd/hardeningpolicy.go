@@ -0,0 +1,189 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	_ "embed"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/warpcomdev/think8shook/internal/webhook"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// PolicyGroupVersion is the API version of the versioned policy files
+var PolicyGroupVersion = schema.GroupVersion{Group: "think8shook.io", Version: "v1alpha1"}
+
+// HardeningPolicyKind is the kind of the versioned policy files
+const HardeningPolicyKind = "HardeningPolicy"
+
+func init() {
+	utilruntime.Must(addPolicyTypes(webhook.Scheme()))
+}
+
+func addPolicyTypes(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypeWithName(PolicyGroupVersion.WithKind(HardeningPolicyKind), &HardeningPolicy{})
+	return nil
+}
+
+// HardeningPolicy is the versioned format of the policy config file.
+// The spec has the same fields as the unversioned file, plus the
+// declarative mutation rules.
+type HardeningPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              policyConfig `json:"spec"`
+}
+
+// DeepCopyInto copies the policy into out
+func (p *HardeningPolicy) DeepCopyInto(out *HardeningPolicy) {
+	*out = *p
+	p.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	p.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy returns a copy of the policy
+func (p *HardeningPolicy) DeepCopy() *HardeningPolicy {
+	if p == nil {
+		return nil
+	}
+	out := &HardeningPolicy{}
+	p.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object
+func (p *HardeningPolicy) DeepCopyObject() runtime.Object {
+	if c := p.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the policy config into out. The compiled rules
+// are immutable, so they are shared.
+func (cfg *policyConfig) DeepCopyInto(out *policyConfig) {
+	*out = *cfg
+	cfg.SeccompProfile.DeepCopyInto(&out.SeccompProfile)
+	out.AllowedCapabilities = slices.Clone(cfg.AllowedCapabilities)
+	cfg.Exemptions.DeepCopyInto(&out.Exemptions)
+	out.Rules = slices.Clone(cfg.Rules)
+	out.DisabledRules = slices.Clone(cfg.DisabledRules)
+	if cfg.Mutations != nil {
+		out.Mutations = make([]mutationSpec, len(cfg.Mutations))
+		for idx := range cfg.Mutations {
+			cfg.Mutations[idx].DeepCopyInto(&out.Mutations[idx])
+		}
+	}
+	out.compiled = slices.Clone(cfg.compiled)
+}
+
+// DeepCopyInto copies the exemptions into out. Image patterns are
+// immutable, so they are shared.
+func (cfg *exemptionConfig) DeepCopyInto(out *exemptionConfig) {
+	*out = *cfg
+	out.NamespaceLabels = maps.Clone(cfg.NamespaceLabels)
+	out.PodLabels = maps.Clone(cfg.PodLabels)
+	out.ServiceAccounts = slices.Clone(cfg.ServiceAccounts)
+	out.Users = slices.Clone(cfg.Users)
+	out.Groups = slices.Clone(cfg.Groups)
+	out.Images = slices.Clone(cfg.Images)
+}
+
+// DeepCopyInto copies the mutation into out
+func (spec *mutationSpec) DeepCopyInto(out *mutationSpec) {
+	*out = *spec
+	if spec.Match != nil {
+		out.Match = &mutationMatch{}
+		spec.Match.DeepCopyInto(out.Match)
+	}
+	if spec.Actions != nil {
+		out.Actions = make([]mutationAction, len(spec.Actions))
+		for idx := range spec.Actions {
+			spec.Actions[idx].DeepCopyInto(&out.Actions[idx])
+		}
+	}
+}
+
+// DeepCopyInto copies the match into out
+func (m *mutationMatch) DeepCopyInto(out *mutationMatch) {
+	*out = *m
+	out.Namespaces = slices.Clone(m.Namespaces)
+	out.ExcludeNamespaces = slices.Clone(m.ExcludeNamespaces)
+	out.Labels = m.Labels.DeepCopy()
+	out.Images = slices.Clone(m.Images)
+	out.Operations = slices.Clone(m.Operations)
+}
+
+// DeepCopyInto copies the action into out
+func (a *mutationAction) DeepCopyInto(out *mutationAction) {
+	*out = *a
+	out.SetIfAbsent = a.SetIfAbsent.deepCopy()
+	out.Force = a.Force.deepCopy()
+	if a.AddLabel != nil {
+		label := *a.AddLabel
+		out.AddLabel = &label
+	}
+}
+
+func (v *fieldValue) deepCopy() *fieldValue {
+	if v == nil {
+		return nil
+	}
+	out := *v
+	out.Value = slices.Clone(v.Value)
+	if v.ValueFrom != nil {
+		source := *v.ValueFrom
+		source.Fields = slices.Clone(v.ValueFrom.Fields)
+		out.ValueFrom = &source
+	}
+	return &out
+}
+
+//go:embed default_policy.yaml
+var defaultPolicyYAML []byte
+
+// isVersionedPolicy returns true if the policy file sets apiVersion or kind
+func isVersionedPolicy(data []byte) bool {
+	var meta metav1.TypeMeta
+	if err := yaml.Unmarshal(data, &meta); err != nil {
+		return false
+	}
+	return meta.APIVersion != "" || meta.Kind != ""
+}
+
+// decodeHardeningPolicy decodes a versioned policy through the webhook
+// scheme. Fields not set in the file keep the values in cfg.
+func decodeHardeningPolicy(data []byte, cfg policyConfig) (policyConfig, error) {
+	decoder := serializer.NewCodecFactory(webhook.Scheme(), serializer.EnableStrict).UniversalDeserializer()
+	into := &HardeningPolicy{Spec: cfg}
+	obj, gvk, err := decoder.Decode(data, nil, into)
+	if err != nil {
+		return cfg, err
+	}
+	decoded, ok := obj.(*HardeningPolicy)
+	if !ok {
+		return cfg, fmt.Errorf("expected %s, got %s", PolicyGroupVersion.WithKind(HardeningPolicyKind), gvk)
+	}
+	return decoded.Spec, nil
+}
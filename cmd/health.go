@@ -0,0 +1,159 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// healthCheck reports an error while a component is not healthy
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// healthChecks is a list of named checks, safe for concurrent use
+type healthChecks struct {
+	mu     sync.RWMutex
+	checks []healthCheck
+}
+
+func (h *healthChecks) add(name string, check func() error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, healthCheck{name: name, check: check})
+}
+
+func (h *healthChecks) list() []healthCheck {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]healthCheck(nil), h.checks...)
+}
+
+var (
+	// livenessChecks fail when the process must be restarted
+	livenessChecks = &healthChecks{}
+	// readinessChecks fail while the webhook must not receive requests
+	readinessChecks = &healthChecks{}
+)
+
+// certificateSource provides the serving certificate
+type certificateSource interface {
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// servingCertificates holds the certificateSource once it has been set up
+var servingCertificates atomic.Value
+
+// getServingCertificate returns the certificate provided by the
+// certificateSource, for tls.Config
+func getServingCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	source, ok := servingCertificates.Load().(certificateSource)
+	if !ok {
+		return nil, errors.New("certificate not loaded")
+	}
+	return source.GetCertificate(hello)
+}
+
+func init() {
+	livenessChecks.add("ping", func() error { return nil })
+	readinessChecks.add("shutdown", checkShutdown)
+	readinessChecks.add("certificate", func() error {
+		_, err := getServingCertificate(nil)
+		return err
+	})
+}
+
+// serveHealth runs the checks and reports the result. With the verbose
+// query parameter, or when any check fails, the result of each check
+// is listed.
+func serveHealth(checks ...*healthChecks) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var report strings.Builder
+		failed := false
+		for _, list := range checks {
+			for _, check := range list.list() {
+				if err := check.check(); err != nil {
+					failed = true
+					fmt.Fprintf(&report, "[-]%s failed: %v\n", check.name, err)
+				} else {
+					fmt.Fprintf(&report, "[+]%s ok\n", check.name)
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if failed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "%scheck failed\n", report.String())
+			return
+		}
+		if _, verbose := r.URL.Query()["verbose"]; verbose {
+			fmt.Fprintf(w, "%scheck passed\n", report.String())
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+}
+
+// registerHealth adds the health and metrics endpoints to mux
+func registerHealth(mux *http.ServeMux) {
+	mux.Handle("/livez", serveHealth(livenessChecks))
+	mux.Handle("/readyz", serveHealth(readinessChecks))
+	mux.Handle("/healthz", serveHealth(livenessChecks, readinessChecks))
+	mux.Handle("/metrics", serveMetrics())
+}
+
+// startHealthServer serves the health and metrics endpoints in a separate
+// port, in plain HTTP unless useTLS is set. Returns the error if the port
+// cannot be listened on.
+func startHealthServer(port int, useTLS bool) (*http.Server, error) {
+	mux := http.NewServeMux()
+	registerHealth(mux)
+	server := &http.Server{
+		ReadHeaderTimeout: 5 * time.Second,
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           mux,
+	}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("health server failed: %w", err)
+	}
+	go func() {
+		var err error
+		if useTLS {
+			server.TLSConfig = &tls.Config{GetCertificate: getServingCertificate}
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			klog.Errorf("health server failed: %v", err)
+		}
+	}()
+	return server, nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthChecks(t *testing.T) {
+	liveness := &healthChecks{}
+	liveness.add("ping", func() error { return nil })
+	readiness := &healthChecks{}
+	synced := false
+	readiness.add("informers", func() error {
+		if !synced {
+			return errors.New("namespace informer not synced")
+		}
+		return nil
+	})
+	probe := func(handler http.HandlerFunc, target string) (int, string) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := probe(serveHealth(liveness), "/livez")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok", body)
+
+	// Failures always list every check
+	code, body = probe(serveHealth(liveness, readiness), "/healthz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "[+]ping ok\n[-]informers failed: namespace informer not synced\ncheck failed\n", body)
+
+	synced = true
+	code, body = probe(serveHealth(readiness), "/readyz")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok", body)
+	code, body = probe(serveHealth(liveness, readiness), "/healthz?verbose")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "[+]ping ok\n[+]informers ok\ncheck passed\n", body)
+}
+
+func TestReadinessRequiresCertificate(t *testing.T) {
+	mux := http.NewServeMux()
+	registerHealth(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Contains(t, rec.Body.String(), "[-]certificate failed: certificate not loaded")
+
+	// Liveness does not depend on the certificate
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestHealthServerListenError(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	// The port is in use, the error is returned instead of exiting
+	_, err = startHealthServer(port, false)
+	require.Error(t, err)
+}
@@ -17,11 +17,16 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -31,15 +36,41 @@ import (
 	"k8s.io/api/admission/v1beta1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
-	// TODO: try this library to see if it generates correct json patch
-	// https://github.com/mattbaird/jsonpatch
 )
 
 var (
-	certFile string
-	keyFile  string
-	port     int
+	certFile            string
+	keyFile             string
+	port                int
+	policyFile          string
+	policyFlags         policyConfig
+	namespaceDefaults   bool
+	namespaceExemptions bool
+	kubeconfig          string
+
+	selfManagedCerts        bool
+	certSecret              string
+	certService             string
+	mutatingWebhookConfig   string
+	validatingWebhookConfig string
+
+	clientCAFile       string
+	clientAllowedNames []string
+
+	drainPeriod     time.Duration
+	shutdownTimeout time.Duration
+
+	healthPort int
+	healthTLS  bool
+
+	captureDir               string
+	captureNamespaces        []string
+	captureExcludeNamespaces []string
+	captureRate              float64
+	captureMaxFiles          int
 )
 
 // CmdWebhook is used by agnhost Cobra.
@@ -63,10 +94,86 @@ func init() {
 		"File containing the default x509 private key matching --tls-cert-file.")
 	CmdWebhook.PersistentFlags().IntVarP(&port, "port", "p", 8443,
 		"Secure port that the webhook listens on")
+	addPolicyFlags(CmdWebhook.Flags(), &policyFlags, &policyFile)
+	CmdWebhook.Flags().BoolVar(&namespaceDefaults, "namespace-defaults", false,
+		"Read per-namespace uid / gid / fsGroup ranges from namespace annotations. Requires list / watch permissions on namespaces.")
+	CmdWebhook.Flags().BoolVar(&namespaceExemptions, "namespace-exemptions", false,
+		"Exempt pods by the labels of their namespace (exemptions.namespaceLabels). Requires list / watch permissions on namespaces.")
+	CmdWebhook.Flags().StringVar(&kubeconfig, "kubeconfig", "",
+		"Path to a kubeconfig file. Only required when running out of cluster.")
+	CmdWebhook.Flags().BoolVar(&selfManagedCerts, "self-managed-certs", false,
+		"Generate a CA and serving certificate, store them in --cert-secret and renew them before expiry, instead of reading --tls-cert-file and --tls-private-key-file.")
+	CmdWebhook.Flags().StringVar(&certSecret, "cert-secret", "",
+		"Secret holding the self-managed certificates, as namespace/name.")
+	CmdWebhook.Flags().StringVar(&certService, "service", "",
+		"Service fronting the webhook, as namespace/name. Its DNS names are included in the self-managed serving certificate.")
+	CmdWebhook.Flags().StringVar(&mutatingWebhookConfig, "mutating-webhook-config", "",
+		"MutatingWebhookConfiguration to inject the self-managed CA bundle into.")
+	CmdWebhook.Flags().StringVar(&validatingWebhookConfig, "validating-webhook-config", "",
+		"ValidatingWebhookConfiguration to inject the self-managed CA bundle into.")
+	CmdWebhook.Flags().StringVar(&clientCAFile, "client-ca-file", "",
+		"File with the CA certificates used to verify client certificates. If set, admission requests without a verified client certificate are rejected.")
+	CmdWebhook.Flags().StringSliceVar(&clientAllowedNames, "client-allowed-names", nil,
+		"Comma separated list of client certificate common names or DNS names allowed to call the admission endpoints. Requires --client-ca-file.")
+	CmdWebhook.Flags().DurationVar(&drainPeriod, "drain-period", defaultDrainPeriod,
+		"Time to keep serving after SIGTERM with /readyz failing, so that the endpoint is removed from the service before shutting down.")
+	CmdWebhook.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout,
+		"Maximum time to wait for in-flight requests to finish after the drain period.")
+	CmdWebhook.Flags().IntVar(&healthPort, "health-port", 0,
+		"Port serving /livez, /readyz, /healthz and /metrics, in plain HTTP unless --health-tls is set. Disabled if 0; the endpoints are always available in the secure port.")
+	CmdWebhook.Flags().BoolVar(&healthTLS, "health-tls", false,
+		"Serve the health port with the webhook certificate.")
+	CmdWebhook.Flags().StringVar(&captureDir, "capture-dir", "",
+		"Directory to write the pods admitted by the mutating webhook to, as sanitized test fixtures. Capture is disabled if empty.")
+	CmdWebhook.Flags().StringSliceVar(&captureNamespaces, "capture-namespaces", nil,
+		"Comma separated list of namespaces to capture pods from. All namespaces if empty.")
+	CmdWebhook.Flags().StringSliceVar(&captureExcludeNamespaces, "capture-exclude-namespaces", nil,
+		"Comma separated list of namespaces not to capture pods from.")
+	CmdWebhook.Flags().Float64Var(&captureRate, "capture-rate", 1,
+		"Maximum number of fixtures captured per second.")
+	CmdWebhook.Flags().IntVar(&captureMaxFiles, "capture-max-files", 100,
+		"Number of fixtures to capture before stopping the capture.")
 	CmdWebhook.Flags().AddGoFlagSet(&fs)
+}
+
+// newClientset builds a client from the kubeconfig file,
+// or the in-cluster config if empty
+func newClientset(kubeconfig string) (kubernetes.Interface, error) {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restConfig)
+}
 
-	CmdWebhook.MarkPersistentFlagRequired("tls-cert-file")
-	CmdWebhook.MarkPersistentFlagRequired("tls-private-key-file")
+// splitNamespacedName parses a namespace/name flag value
+func splitNamespacedName(flag, value string) (string, string, error) {
+	namespace, name, found := strings.Cut(value, "/")
+	if !found || namespace == "" || name == "" {
+		return "", "", fmt.Errorf("--%s must have format namespace/name, got %q", flag, value)
+	}
+	return namespace, name, nil
+}
+
+// startCertManager provisions the self-managed certificates and keeps
+// renewing them in the background
+func startCertManager(ctx context.Context, client kubernetes.Interface) (*certManager, error) {
+	secretNamespace, secretName, err := splitNamespacedName("cert-secret", certSecret)
+	if err != nil {
+		return nil, err
+	}
+	serviceNamespace, serviceName, err := splitNamespacedName("service", certService)
+	if err != nil {
+		return nil, err
+	}
+	manager := newCertManager(client, secretNamespace, secretName, serviceDNSNames(serviceNamespace, serviceName))
+	manager.mutatingWebhookConfig = mutatingWebhookConfig
+	manager.validatingWebhookConfig = validatingWebhookConfig
+	if err := manager.ensure(ctx); err != nil {
+		return nil, err
+	}
+	go manager.Start(ctx)
+	return manager, nil
 }
 
 // AdmitHandler exposes the interface to create a dual v1 / v1beta1 handler
@@ -92,13 +199,15 @@ func serve(w http.ResponseWriter, r *http.Request, admit AdmitHandler, codecs *s
 		return
 	}
 
-	klog.V(2).Info(fmt.Sprintf("handling request: %s", body))
+	// Bodies are large, use --capture-dir to keep the admitted pods
+	klog.V(5).Info(fmt.Sprintf("handling request: %s", body))
 
 	deserializer := codecs.UniversalDeserializer()
 	obj, gvk, err := deserializer.Decode(body, nil, nil)
 	if err != nil {
 		msg := fmt.Sprintf("Request could not be decoded: %v", err)
 		klog.Error(msg)
+		decodeErrors.Inc()
 		http.Error(w, msg, http.StatusBadRequest)
 		return
 	}
@@ -134,10 +243,11 @@ func serve(w http.ResponseWriter, r *http.Request, admit AdmitHandler, codecs *s
 		return
 	}
 
-	klog.V(2).Info(fmt.Sprintf("sending response: %v", responseObj))
+	klog.V(5).Info(fmt.Sprintf("sending response: %v", responseObj))
 	respBytes, err := json.Marshal(responseObj)
 	if err != nil {
 		klog.Error(err)
+		marshalErrors.Inc()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -151,29 +261,118 @@ func serveMutatePods(codecs *serializer.CodecFactory) http.Handler {
 	closure := webhook.NewDelegateToV1AdmitHandler(func(ar v1.AdmissionReview) *v1.AdmissionResponse {
 		return mutateSecurityContext(ar, codecs)
 	})
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return instrument(mutatingWebhook, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		serve(w, r, closure, codecs)
+	}))
+}
+
+func serveValidatePods(codecs *serializer.CodecFactory) http.Handler {
+	closure := webhook.NewDelegateToV1AdmitHandler(func(ar v1.AdmissionReview) *v1.AdmissionResponse {
+		return validateSecurityContext(ar, codecs)
 	})
+	return instrument(validatingWebhook, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serve(w, r, closure, codecs)
+	}))
 }
 
 func main(cmd *cobra.Command, args []string) {
-	config := webhook.Config{
-		CertFile: certFile,
-		KeyFile:  keyFile,
+	ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	cfg, err := loadPolicyConfig(policyFile, cmd.Flags(), policyFlags)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	policy = cfg
+	// Probes must be answered while the informers and certificates are set up
+	if healthPort != 0 {
+		healthServer, err := startHealthServer(healthPort, healthTLS)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		defer healthServer.Close()
+	}
+	watchNamespaces := namespaceDefaults || namespaceExemptions
+	if len(policy.Exemptions.NamespaceLabels) > 0 && !namespaceExemptions {
+		klog.Warningf("namespace label exemptions %v will not apply unless --namespace-exemptions is set", policy.Exemptions.NamespaceLabels)
+	}
+	var client kubernetes.Interface
+	if watchNamespaces || selfManagedCerts {
+		if client, err = newClientset(kubeconfig); err != nil {
+			klog.Fatal(err)
+		}
+	}
+	if watchNamespaces {
+		lister, err := startNamespaceInformer(ctx, client)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		namespaceLister = lister
+	}
+	if selfManagedCerts {
+		manager, err := startCertManager(ctx, client)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		servingCertificates.Store(certificateSource(manager))
+	} else {
+		if certFile == "" || keyFile == "" {
+			klog.Fatal("--tls-cert-file and --tls-private-key-file are required unless --self-managed-certs is set")
+		}
+		certs, err := newCertWatcher(certFile, keyFile)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		go func() {
+			if err := certs.Start(ctx); err != nil {
+				klog.Errorf("certificate reload disabled: %v", err)
+			}
+		}()
+		servingCertificates.Store(certificateSource(certs))
+	}
+	if captureDir != "" {
+		recorder, err := newAdmissionRecorder(captureDir, captureNamespaces, captureExcludeNamespaces, captureRate, captureMaxFiles)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		go recorder.Start(ctx)
+		podRecorder = recorder
+	}
+	tlsConfig := &tls.Config{GetCertificate: getServingCertificate}
+	var auth *clientAuth
+	if clientCAFile != "" {
+		pool, err := loadClientCAs(clientCAFile)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		// Probes and scrapers do not present certificates, so the
+		// client certificate is only required by the admission endpoints
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		auth = &clientAuth{allowedNames: clientAllowedNames}
+	} else if len(clientAllowedNames) > 0 {
+		klog.Fatal("--client-allowed-names requires --client-ca-file")
 	}
 	codecs := webhook.Codecs()
-	http.Handle("/mutating-pods", serveMutatePods(codecs))
-	http.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) { w.Write([]byte("ok")) })
+	for _, endpoint := range admissionEndpoints {
+		handler := endpoint.handler(codecs)
+		if auth != nil {
+			handler = auth.wrap(handler)
+		}
+		http.Handle(endpoint.path, handler)
+	}
+	registerHealth(http.DefaultServeMux)
 	server := &http.Server{
 		ReadTimeout:       10 * time.Second,
 		WriteTimeout:      10 * time.Second,
 		ReadHeaderTimeout: 5 * time.Second,
 		MaxHeaderBytes:    65535,
 		Addr:              fmt.Sprintf(":%d", port),
-		TLSConfig:         config.TLS(),
+		TLSConfig:         tlsConfig,
 	}
-	err := server.ListenAndServeTLS("", "")
+	err = serveUntilDone(ctx, server, func() error {
+		return server.ListenAndServeTLS("", "")
+	}, drainPeriod, shutdownTimeout)
 	if err != nil {
-		panic(err)
+		klog.Fatal(err)
 	}
 }
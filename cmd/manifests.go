@@ -0,0 +1,372 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+// Ports used by the rendered deployment
+const (
+	manifestsHealthPort  = 8080
+	manifestsServicePort = 443
+	manifestsTLSDir      = "/etc/think8shook/tls"
+)
+
+// manifestsOptions are the flags of the manifests subcommand
+type manifestsOptions struct {
+	namespace         string
+	name              string
+	image             string
+	replicas          int32
+	failurePolicy     string
+	namespaceSelector string
+	selfManagedCerts  bool
+	tlsSecret         string
+}
+
+var manifestsFlags manifestsOptions
+
+// CmdManifests renders the manifests to deploy the webhook
+var CmdManifests = &cobra.Command{
+	Use:   "manifests",
+	Short: "Renders the manifests to deploy the webhook",
+	Long: `Renders the Namespace, RBAC, Service, Deployment and webhook configurations needed
+to deploy the webhook. The webhooks match the endpoints registered by the server.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return manifestsFlags.render(cmd.OutOrStdout())
+	},
+}
+
+func init() {
+	CmdManifests.Flags().StringVar(&manifestsFlags.namespace, "namespace", "think8shook",
+		"Namespace to deploy the webhook to. It is excluded from the webhooks.")
+	CmdManifests.Flags().StringVar(&manifestsFlags.name, "name", "think8shook",
+		"Name of the deployment, service, service account and webhook configurations.")
+	CmdManifests.Flags().StringVar(&manifestsFlags.image, "image", "",
+		"Container image of the webhook.")
+	CmdManifests.Flags().Int32Var(&manifestsFlags.replicas, "replicas", 2,
+		"Number of replicas of the webhook.")
+	CmdManifests.Flags().StringVar(&manifestsFlags.failurePolicy, "failure-policy", string(admissionregistrationv1.Fail),
+		"Failure policy of the webhooks (Fail or Ignore).")
+	CmdManifests.Flags().StringVar(&manifestsFlags.namespaceSelector, "namespace-selector", "",
+		"Label selector of the namespaces the webhooks apply to, e.g. think8shook.io/enabled=true. kube-system and the webhook namespace are always excluded.")
+	CmdManifests.Flags().BoolVar(&manifestsFlags.selfManagedCerts, "self-managed-certs", true,
+		"Let the webhook manage its certificates and CA bundle. If false, the certificate is mounted from --tls-secret.")
+	CmdManifests.Flags().StringVar(&manifestsFlags.tlsSecret, "tls-secret", "",
+		"kubernetes.io/tls Secret with the serving certificate, when certificates are not self-managed. Defaults to <name>-tls.")
+	CmdManifests.MarkFlagRequired("image")
+	CmdWebhook.AddCommand(CmdManifests)
+}
+
+// render writes the manifests as a multi-document YAML
+func (o manifestsOptions) render(out io.Writer) error {
+	objects, err := o.objects()
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(out, "---\n%s", data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objects returns the objects to deploy, in the order they must be applied
+func (o manifestsOptions) objects() ([]runtime.Object, error) {
+	if o.image == "" {
+		return nil, errors.New("--image is required")
+	}
+	failurePolicy := admissionregistrationv1.FailurePolicyType(o.failurePolicy)
+	if failurePolicy != admissionregistrationv1.Fail && failurePolicy != admissionregistrationv1.Ignore {
+		return nil, fmt.Errorf("--failure-policy must be %s or %s, got %q", admissionregistrationv1.Fail, admissionregistrationv1.Ignore, o.failurePolicy)
+	}
+	namespaceSelector, err := o.webhookNamespaceSelector()
+	if err != nil {
+		return nil, err
+	}
+	objects := []runtime.Object{
+		&corev1.Namespace{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+			ObjectMeta: metav1.ObjectMeta{Name: o.namespace},
+		},
+		&corev1.ServiceAccount{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: o.objectMeta(),
+		},
+	}
+	objects = append(objects, o.rbac()...)
+	objects = append(objects, o.service(), o.deployment())
+
+	mutating := &admissionregistrationv1.MutatingWebhookConfiguration{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "MutatingWebhookConfiguration"},
+		ObjectMeta: metav1.ObjectMeta{Name: o.name, Labels: o.labels()},
+	}
+	validating := &admissionregistrationv1.ValidatingWebhookConfiguration{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "ValidatingWebhookConfiguration"},
+		ObjectMeta: metav1.ObjectMeta{Name: o.name, Labels: o.labels()},
+	}
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	timeoutSeconds := int32(10)
+	for _, endpoint := range admissionEndpoints {
+		path := endpoint.path
+		port := int32(manifestsServicePort)
+		clientConfig := admissionregistrationv1.WebhookClientConfig{
+			Service: &admissionregistrationv1.ServiceReference{
+				Namespace: o.namespace,
+				Name:      o.name,
+				Path:      &path,
+				Port:      &port,
+			},
+		}
+		if endpoint.mutating {
+			mutating.Webhooks = append(mutating.Webhooks, admissionregistrationv1.MutatingWebhook{
+				Name:                    endpoint.webhookName(),
+				ClientConfig:            clientConfig,
+				Rules:                   endpoint.rules(),
+				FailurePolicy:           &failurePolicy,
+				NamespaceSelector:       namespaceSelector,
+				SideEffects:             &sideEffects,
+				TimeoutSeconds:          &timeoutSeconds,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			})
+		} else {
+			validating.Webhooks = append(validating.Webhooks, admissionregistrationv1.ValidatingWebhook{
+				Name:                    endpoint.webhookName(),
+				ClientConfig:            clientConfig,
+				Rules:                   endpoint.rules(),
+				FailurePolicy:           &failurePolicy,
+				NamespaceSelector:       namespaceSelector,
+				SideEffects:             &sideEffects,
+				TimeoutSeconds:          &timeoutSeconds,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			})
+		}
+	}
+	if len(mutating.Webhooks) > 0 {
+		objects = append(objects, mutating)
+	}
+	if len(validating.Webhooks) > 0 {
+		objects = append(objects, validating)
+	}
+	return objects, nil
+}
+
+func (o manifestsOptions) labels() map[string]string {
+	return map[string]string{"app.kubernetes.io/name": o.name}
+}
+
+func (o manifestsOptions) objectMeta() metav1.ObjectMeta {
+	return metav1.ObjectMeta{Namespace: o.namespace, Name: o.name, Labels: o.labels()}
+}
+
+// webhookNamespaceSelector combines the user selector with the exclusion
+// of kube-system and the webhook namespace, so that the webhook never
+// blocks its own pods or the control plane
+func (o manifestsOptions) webhookNamespaceSelector() (*metav1.LabelSelector, error) {
+	selector := &metav1.LabelSelector{}
+	if o.namespaceSelector != "" {
+		parsed, err := metav1.ParseToLabelSelector(o.namespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --namespace-selector: %w", err)
+		}
+		selector = parsed
+	}
+	selector.MatchExpressions = append(selector.MatchExpressions, metav1.LabelSelectorRequirement{
+		Key:      corev1.LabelMetadataName,
+		Operator: metav1.LabelSelectorOpNotIn,
+		Values:   []string{metav1.NamespaceSystem, o.namespace},
+	})
+	return selector, nil
+}
+
+// rbac returns the roles required by the webhook: namespaces are read for
+// per-namespace defaults and exemptions, and self-managed certificates
+// need to update their Secret and the webhook configurations
+func (o manifestsOptions) rbac() []runtime.Object {
+	clusterRole := &rbacv1.ClusterRole{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+		ObjectMeta: metav1.ObjectMeta{Name: o.name, Labels: o.labels()},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{""},
+			Resources: []string{"namespaces"},
+			Verbs:     []string{"get", "list", "watch"},
+		}},
+	}
+	subjects := []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Namespace: o.namespace, Name: o.name}}
+	objects := []runtime.Object{clusterRole}
+	if o.selfManagedCerts {
+		clusterRole.Rules = append(clusterRole.Rules, rbacv1.PolicyRule{
+			APIGroups:     []string{"admissionregistration.k8s.io"},
+			Resources:     []string{"mutatingwebhookconfigurations", "validatingwebhookconfigurations"},
+			ResourceNames: []string{o.name},
+			Verbs:         []string{"get", "update"},
+		})
+	}
+	objects = append(objects, &rbacv1.ClusterRoleBinding{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRoleBinding"},
+		ObjectMeta: metav1.ObjectMeta{Name: o.name, Labels: o.labels()},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: o.name},
+		Subjects:   subjects,
+	})
+	if o.selfManagedCerts {
+		objects = append(objects, &rbacv1.Role{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "Role"},
+			ObjectMeta: o.objectMeta(),
+			Rules: []rbacv1.PolicyRule{
+				{
+					APIGroups: []string{""},
+					Resources: []string{"secrets"},
+					Verbs:     []string{"create"},
+				},
+				{
+					APIGroups:     []string{""},
+					Resources:     []string{"secrets"},
+					ResourceNames: []string{o.certSecret()},
+					Verbs:         []string{"get", "update"},
+				},
+			},
+		}, &rbacv1.RoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "RoleBinding"},
+			ObjectMeta: o.objectMeta(),
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: o.name},
+			Subjects:   subjects,
+		})
+	}
+	return objects
+}
+
+// certSecret returns the name of the Secret with the serving certificate
+func (o manifestsOptions) certSecret() string {
+	if o.selfManagedCerts {
+		return o.name + "-certs"
+	}
+	if o.tlsSecret != "" {
+		return o.tlsSecret
+	}
+	return o.name + "-tls"
+}
+
+func (o manifestsOptions) service() *corev1.Service {
+	return &corev1.Service{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: o.objectMeta(),
+		Spec: corev1.ServiceSpec{
+			Selector: o.labels(),
+			Ports: []corev1.ServicePort{{
+				Name:       "https",
+				Port:       manifestsServicePort,
+				TargetPort: intstr.FromString("https"),
+			}},
+		},
+	}
+}
+
+func (o manifestsOptions) deployment() *appsv1.Deployment {
+	args := []string{
+		fmt.Sprintf("--port=%d", port),
+		fmt.Sprintf("--health-port=%d", manifestsHealthPort),
+		// RBAC grants access to namespaces, so the default exemptions apply
+		"--namespace-exemptions",
+	}
+	var volumes []corev1.Volume
+	var volumeMounts []corev1.VolumeMount
+	if o.selfManagedCerts {
+		args = append(args,
+			"--self-managed-certs",
+			fmt.Sprintf("--cert-secret=%s/%s", o.namespace, o.certSecret()),
+			fmt.Sprintf("--service=%s/%s", o.namespace, o.name),
+			fmt.Sprintf("--mutating-webhook-config=%s", o.name),
+			fmt.Sprintf("--validating-webhook-config=%s", o.name),
+		)
+	} else {
+		args = append(args,
+			fmt.Sprintf("--tls-cert-file=%s/%s", manifestsTLSDir, corev1.TLSCertKey),
+			fmt.Sprintf("--tls-private-key-file=%s/%s", manifestsTLSDir, corev1.TLSPrivateKeyKey),
+		)
+		volumes = []corev1.Volume{{
+			Name:         "tls",
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: o.certSecret()}},
+		}}
+		volumeMounts = []corev1.VolumeMount{{Name: "tls", MountPath: manifestsTLSDir, ReadOnly: true}}
+	}
+	replicas := o.replicas
+	nonRoot, noEscalation, readOnly := true, false, true
+	// Drain period and shutdown timeout must fit in the grace period
+	gracePeriod := int64((defaultDrainPeriod + defaultShutdownTimeout).Seconds()) + 5
+	probe := func(path string) *corev1.Probe {
+		return &corev1.Probe{ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{
+			Path: path,
+			Port: intstr.FromString("health"),
+		}}}
+	}
+	return &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: o.objectMeta(),
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: o.labels()},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: o.labels()},
+				Spec: corev1.PodSpec{
+					ServiceAccountName:            o.name,
+					TerminationGracePeriodSeconds: &gracePeriod,
+					SecurityContext: &corev1.PodSecurityContext{
+						RunAsNonRoot:   &nonRoot,
+						SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+					},
+					Containers: []corev1.Container{{
+						Name:  "webhook",
+						Image: o.image,
+						Args:  args,
+						Ports: []corev1.ContainerPort{
+							{Name: "https", ContainerPort: int32(port)},
+							{Name: "health", ContainerPort: manifestsHealthPort},
+						},
+						LivenessProbe:  probe("/livez"),
+						ReadinessProbe: probe("/readyz"),
+						SecurityContext: &corev1.SecurityContext{
+							AllowPrivilegeEscalation: &noEscalation,
+							ReadOnlyRootFilesystem:   &readOnly,
+							Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+						},
+						VolumeMounts: volumeMounts,
+					}},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+}
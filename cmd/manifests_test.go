@@ -0,0 +1,121 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestManifests(t *testing.T) {
+	options := manifestsOptions{
+		namespace:         "hooks",
+		name:              "think8shook",
+		image:             "example.com/think8shook:v1",
+		replicas:          3,
+		failurePolicy:     "Ignore",
+		namespaceSelector: "think8shook.io/enabled=true",
+		selfManagedCerts:  true,
+	}
+	var out bytes.Buffer
+	require.NoError(t, options.render(&out))
+
+	documents := map[string][]byte{}
+	for _, doc := range strings.Split(out.String(), "---\n")[1:] {
+		var meta metav1.TypeMeta
+		require.NoError(t, yaml.Unmarshal([]byte(doc), &meta))
+		documents[meta.Kind] = []byte(doc)
+	}
+	require.ElementsMatch(t, []string{
+		"Namespace", "ServiceAccount", "ClusterRole", "ClusterRoleBinding", "Role", "RoleBinding",
+		"Service", "Deployment", "MutatingWebhookConfiguration", "ValidatingWebhookConfiguration",
+	}, slices.Collect(maps.Keys(documents)))
+
+	var deployment appsv1.Deployment
+	require.NoError(t, yaml.Unmarshal(documents["Deployment"], &deployment))
+	require.Equal(t, int32(3), *deployment.Spec.Replicas)
+	container := deployment.Spec.Template.Spec.Containers[0]
+	require.Equal(t, options.image, container.Image)
+	require.Contains(t, container.Args, "--self-managed-certs")
+	require.Contains(t, container.Args, "--namespace-exemptions")
+	require.Contains(t, container.Args, "--service=hooks/think8shook")
+	require.Contains(t, container.Args, "--cert-secret=hooks/think8shook-certs")
+
+	var mutating admissionregistrationv1.MutatingWebhookConfiguration
+	require.NoError(t, yaml.Unmarshal(documents["MutatingWebhookConfiguration"], &mutating))
+	var validating admissionregistrationv1.ValidatingWebhookConfiguration
+	require.NoError(t, yaml.Unmarshal(documents["ValidatingWebhookConfiguration"], &validating))
+
+	// Every endpoint served by the webhook must have a webhook configured
+	paths := map[string]*metav1.LabelSelector{}
+	for _, webhook := range mutating.Webhooks {
+		require.Equal(t, admissionregistrationv1.Ignore, *webhook.FailurePolicy)
+		paths[*webhook.ClientConfig.Service.Path] = webhook.NamespaceSelector
+	}
+	for _, webhook := range validating.Webhooks {
+		paths[*webhook.ClientConfig.Service.Path] = webhook.NamespaceSelector
+	}
+	require.Len(t, paths, len(admissionEndpoints))
+	for _, endpoint := range admissionEndpoints {
+		selector, ok := paths[endpoint.path]
+		require.True(t, ok, "missing webhook for %s", endpoint.path)
+		require.Equal(t, map[string]string{"think8shook.io/enabled": "true"}, selector.MatchLabels)
+		require.Contains(t, selector.MatchExpressions, metav1.LabelSelectorRequirement{
+			Key:      "kubernetes.io/metadata.name",
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   []string{"kube-system", "hooks"},
+		})
+	}
+}
+
+func TestManifestsMountedCerts(t *testing.T) {
+	options := manifestsOptions{
+		namespace:     "hooks",
+		name:          "think8shook",
+		image:         "example.com/think8shook:v1",
+		replicas:      1,
+		failurePolicy: "Fail",
+	}
+	objects, err := options.objects()
+	require.NoError(t, err)
+	for _, obj := range objects {
+		kind := obj.GetObjectKind().GroupVersionKind().Kind
+		require.NotEqual(t, "Role", kind, "secrets must not be writable without self-managed certs")
+		if deployment, ok := obj.(*appsv1.Deployment); ok {
+			spec := deployment.Spec.Template.Spec
+			require.Equal(t, "think8shook-tls", spec.Volumes[0].Secret.SecretName)
+			require.NotContains(t, spec.Containers[0].Args, "--self-managed-certs")
+		}
+	}
+
+	options.failurePolicy = "Retry"
+	_, err = options.objects()
+	require.Error(t, err)
+	options.failurePolicy = "Fail"
+	options.image = ""
+	_, err = options.objects()
+	require.Error(t, err)
+}
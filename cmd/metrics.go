@@ -0,0 +1,166 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	v1 "k8s.io/api/admission/v1"
+)
+
+const metricsNamespace = "think8shook"
+
+// Webhook types, used as metric label values
+const (
+	mutatingWebhook   = "mutating"
+	validatingWebhook = "validating"
+)
+
+// Admission request outcomes, used as metric label values
+const (
+	outcomeMutated   = "mutated"
+	outcomeUnchanged = "unchanged"
+	outcomeAllowed   = "allowed"
+	outcomeDenied    = "denied"
+	outcomeSkipped   = "skipped"
+	outcomeError     = "error"
+)
+
+var (
+	// metricsRegistry holds the metrics exposed at /metrics
+	metricsRegistry = prometheus.NewRegistry()
+
+	admissionRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_requests_total",
+		Help:      "Admission requests handled, by webhook, kind, operation, namespace and outcome.",
+	}, []string{"webhook", "group", "version", "kind", "operation", "namespace", "outcome"})
+
+	admissionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_duration_seconds",
+		Help:      "Time spent serving admission requests, by webhook.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"webhook"})
+
+	patchesEmitted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "patches_total",
+		Help:      "Mutations sent to the API server, by rule.",
+	}, []string{"rule"})
+
+	ruleMutations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rule_mutations_total",
+		Help:      "Pods or containers changed by each mutation rule.",
+	}, []string{"rule"})
+
+	ruleExpressionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rule_expression_errors_total",
+		Help:      "CEL expressions of the mutation rules that failed or returned invalid values, by rule and expression (match or value).",
+	}, []string{"rule", "expression"})
+
+	decodeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "decode_errors_total",
+		Help:      "Admission reviews or objects that could not be decoded.",
+	})
+
+	marshalErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "marshal_errors_total",
+		Help:      "Objects, patches or admission responses that could not be marshaled.",
+	})
+
+	certificateReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificate_reloads_total",
+		Help:      "Attempts to reload the serving certificate, by result.",
+	}, []string{"result"})
+
+	clientAuthRejections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_auth_rejections_total",
+		Help:      "Admission requests rejected because the client certificate was missing or not allowed.",
+	})
+
+	certificateExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "Expiration time of the serving certificate, in seconds since the epoch.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		admissionRequests,
+		admissionDuration,
+		patchesEmitted,
+		ruleMutations,
+		ruleExpressionErrors,
+		decodeErrors,
+		marshalErrors,
+		certificateReloads,
+		certificateExpiry,
+		clientAuthRejections,
+	)
+}
+
+// countRequest records the outcome of an admission request
+func countRequest(webhookType string, req *v1.AdmissionRequest, outcome string) {
+	admissionRequests.WithLabelValues(
+		webhookType,
+		req.Kind.Group,
+		req.Kind.Version,
+		req.Kind.Kind,
+		string(req.Operation),
+		req.Namespace,
+		outcome,
+	).Inc()
+}
+
+// countPatches records the rules applied by the patches sent
+func countPatches(ps *patchSet) {
+	for _, record := range ps.records {
+		if record.rule != "" {
+			patchesEmitted.WithLabelValues(record.rule).Inc()
+		}
+		if record.source != "" {
+			ruleMutations.WithLabelValues(record.source).Inc()
+		}
+	}
+}
+
+// instrument observes the time spent by the handler
+func instrument(webhookType string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timer := prometheus.NewTimer(admissionDuration.WithLabelValues(webhookType))
+		defer timer.ObserveDuration()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// serveMetrics exposes the metrics in the Prometheus text format
+func serveMetrics() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/warpcomdev/think8shook/internal/webhook"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestMetrics(t *testing.T) {
+	privileged := true
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:            "test",
+				Image:           "busybox/latest",
+				SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+			}},
+		},
+	}
+	review := v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &v1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  podsResource,
+			Namespace: "metrics",
+			Operation: v1.Create,
+			Object:    runtime.RawExtension{Raw: mustMarshal(pod)},
+		},
+	}
+	post := func(handler http.Handler, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	requests := func(webhookType, outcome string) float64 {
+		return testutil.ToFloat64(admissionRequests.WithLabelValues(webhookType, "", "v1", "Pod", "CREATE", "metrics", outcome))
+	}
+
+	mutated := requests(mutatingWebhook, outcomeMutated)
+	denied := requests(validatingWebhook, outcomeDenied)
+	patched := testutil.ToFloat64(patchesEmitted.WithLabelValues("removed-privileged"))
+	decodeFailures := testutil.ToFloat64(decodeErrors)
+
+	codecs := webhook.Codecs()
+	require.Equal(t, http.StatusOK, post(serveMutatePods(codecs), mustMarshal(review)).Code)
+	require.Equal(t, http.StatusOK, post(serveValidatePods(codecs), mustMarshal(review)).Code)
+	require.Equal(t, http.StatusBadRequest, post(serveMutatePods(codecs), []byte("{")).Code)
+
+	require.Equal(t, mutated+1, requests(mutatingWebhook, outcomeMutated))
+	require.Equal(t, denied+1, requests(validatingWebhook, outcomeDenied))
+	require.Equal(t, patched+1, testutil.ToFloat64(patchesEmitted.WithLabelValues("removed-privileged")))
+	require.Equal(t, decodeFailures+1, testutil.ToFloat64(decodeErrors))
+
+	// The endpoint exposes the metrics in the text format
+	rec := httptest.NewRecorder()
+	serveMetrics().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	for _, name := range []string{
+		"think8shook_admission_requests_total",
+		"think8shook_admission_duration_seconds_bucket",
+		"think8shook_patches_total",
+		"think8shook_decode_errors_total",
+		"think8shook_marshal_errors_total",
+	} {
+		require.True(t, strings.Contains(rec.Body.String(), name), "missing metric %s", name)
+	}
+}
@@ -0,0 +1,273 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/spf13/cobra"
+	"github.com/warpcomdev/think8shook/internal/webhook"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	v1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// Output formats of the mutate subcommand
+const (
+	mutateOutputPatch    = "patch"
+	mutateOutputManifest = "manifest"
+	mutateOutputDiff     = "diff"
+)
+
+// errManifestsMutated is returned with --exit-code when any manifest is mutated
+var errManifestsMutated = errors.New("some manifests would be mutated by the webhook")
+
+// mutateOptions are the flags of the mutate subcommand
+type mutateOptions struct {
+	policyFile string
+	policy     policyConfig
+	namespace  string
+	output     string
+	exitCode   bool
+}
+
+var mutateFlags mutateOptions
+
+// CmdMutate runs the mutating webhook against manifests from disk
+var CmdMutate = &cobra.Command{
+	Use:   "mutate [file...]",
+	Short: "Runs the mutating webhook against Pod and workload manifests from disk",
+	Long: `Runs the mutating webhook against the Pod and workload manifests in the given files,
+or stdin if no file or "-" is given, and prints the JSON patches, the mutated manifests or
+a unified diff. Other objects are left untouched. Namespace label exemptions and
+per-namespace defaults are not applied, since they require access to the cluster.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		cfg, err := loadPolicyConfig(mutateFlags.policyFile, cmd.Flags(), mutateFlags.policy)
+		if err != nil {
+			return err
+		}
+		policy = cfg
+		return mutateFlags.run(args, cmd.InOrStdin(), cmd.OutOrStdout(), cmd.ErrOrStderr())
+	},
+}
+
+func init() {
+	addPolicyFlags(CmdMutate.Flags(), &mutateFlags.policy, &mutateFlags.policyFile)
+	CmdMutate.Flags().StringVarP(&mutateFlags.namespace, "namespace", "n", metav1.NamespaceDefault,
+		"Namespace of the manifests that do not specify one.")
+	CmdMutate.Flags().StringVarP(&mutateFlags.output, "output", "o", mutateOutputDiff,
+		"Output format: patch, manifest or diff.")
+	CmdMutate.Flags().BoolVar(&mutateFlags.exitCode, "exit-code", false,
+		"Exit with status 1 if any manifest would be mutated, to use as a CI or pre-commit check.")
+	CmdWebhook.AddCommand(CmdMutate)
+}
+
+// mutatedManifest is the result of running a single document through the webhook
+type mutatedManifest struct {
+	source   string
+	object   metav1.PartialObjectMetadata
+	original []byte
+	mutated  []byte
+	patch    []byte
+	warnings []string
+}
+
+// id identifies the manifest in the output
+func (m mutatedManifest) id() string {
+	name := m.object.Name
+	if m.object.Namespace != "" {
+		name = m.object.Namespace + "/" + name
+	}
+	return fmt.Sprintf("%s %s", m.object.Kind, name)
+}
+
+// run mutates the manifests in the inputs and writes them in the output format
+func (o mutateOptions) run(inputs []string, stdin io.Reader, out, errOut io.Writer) error {
+	switch o.output {
+	case mutateOutputPatch, mutateOutputManifest, mutateOutputDiff:
+	default:
+		return fmt.Errorf("--output must be %s, %s or %s, got %q", mutateOutputPatch, mutateOutputManifest, mutateOutputDiff, o.output)
+	}
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+	mutated := false
+	for _, input := range inputs {
+		manifests, err := o.readInput(input, stdin)
+		if err != nil {
+			return err
+		}
+		for _, manifest := range manifests {
+			for _, warning := range manifest.warnings {
+				fmt.Fprintf(errOut, "Warning: %s: %s\n", manifest.id(), warning)
+			}
+			if manifest.patch != nil {
+				mutated = true
+			}
+			if err := o.write(out, manifest); err != nil {
+				return err
+			}
+		}
+	}
+	if mutated && o.exitCode {
+		return errManifestsMutated
+	}
+	return nil
+}
+
+// readInput mutates all the documents in a file, or stdin if input is "-"
+func (o mutateOptions) readInput(input string, stdin io.Reader) ([]mutatedManifest, error) {
+	reader := stdin
+	source := "stdin"
+	if input != "-" {
+		file, err := os.Open(input)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+		source = input
+	}
+	documents := utilyaml.NewYAMLReader(bufio.NewReader(reader))
+	var manifests []mutatedManifest
+	for {
+		document, err := documents.Read()
+		if errors.Is(err, io.EOF) {
+			return manifests, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		raw, err := yaml.YAMLToJSON(document)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		// Separators and comments produce empty documents
+		if string(raw) == "null" {
+			continue
+		}
+		manifest, err := o.mutate(source, raw)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, manifest)
+	}
+}
+
+// mutate runs a single JSON document through the mutating webhook, as if
+// it was being created
+func (o mutateOptions) mutate(source string, raw []byte) (mutatedManifest, error) {
+	manifest := mutatedManifest{source: source, original: raw, mutated: raw}
+	if err := yaml.Unmarshal(raw, &manifest.object); err != nil {
+		return manifest, fmt.Errorf("%s: %w", source, err)
+	}
+	gvk := manifest.object.GroupVersionKind()
+	gvr, _ := meta.UnsafeGuessKindToResource(gvk)
+	resource := metav1.GroupVersionResource{Group: gvr.Group, Version: gvr.Version, Resource: gvr.Resource}
+	if _, ok := podDecoders[resource]; !ok {
+		return manifest, nil
+	}
+	namespace := manifest.object.Namespace
+	if namespace == "" {
+		namespace = o.namespace
+	}
+	ar := v1.AdmissionReview{
+		Request: &v1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+			Resource:  resource,
+			Namespace: namespace,
+			Name:      manifest.object.Name,
+			Operation: v1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	response := mutateSecurityContext(ar, webhook.Codecs())
+	if response.Result != nil && response.Result.Status == metav1.StatusFailure {
+		return manifest, fmt.Errorf("%s: %s: %s", source, manifest.id(), response.Result.Message)
+	}
+	manifest.warnings = response.Warnings
+	if response.Patch == nil {
+		return manifest, nil
+	}
+	patch, err := jsonpatch.DecodePatch(response.Patch)
+	if err != nil {
+		return manifest, err
+	}
+	mutated, err := patch.Apply(raw)
+	if err != nil {
+		return manifest, fmt.Errorf("%s: %s: %w", source, manifest.id(), err)
+	}
+	manifest.patch = response.Patch
+	manifest.mutated = mutated
+	return manifest, nil
+}
+
+// write prints the manifest in the output format. Patches and diffs
+// are only printed for the mutated manifests.
+func (o mutateOptions) write(out io.Writer, manifest mutatedManifest) error {
+	switch o.output {
+	case mutateOutputPatch:
+		if manifest.patch == nil {
+			return nil
+		}
+		_, err := fmt.Fprintf(out, "# %s: %s\n%s\n", manifest.source, manifest.id(), manifest.patch)
+		return err
+	case mutateOutputManifest:
+		mutated, err := yaml.JSONToYAML(manifest.mutated)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "---\n%s", mutated)
+		return err
+	default:
+		if manifest.patch == nil {
+			return nil
+		}
+		// Both sides are rendered the same way, so that only the
+		// mutations show up in the diff
+		original, err := yaml.JSONToYAML(manifest.original)
+		if err != nil {
+			return err
+		}
+		mutated, err := yaml.JSONToYAML(manifest.mutated)
+		if err != nil {
+			return err
+		}
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(string(original)),
+			B:        difflib.SplitLines(string(mutated)),
+			FromFile: fmt.Sprintf("%s (%s)", manifest.source, manifest.id()),
+			ToFile:   fmt.Sprintf("%s (%s, mutated)", manifest.source, manifest.id()),
+			Context:  3,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(out, diff)
+		return err
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const mutateManifests = `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  containers:
+  - name: web
+    image: nginx
+---
+# Objects without pods are left untouched
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  ports:
+  - port: 80
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+  namespace: prod
+spec:
+  selector:
+    matchLabels:
+      app: api
+  template:
+    metadata:
+      labels:
+        app: api
+    spec:
+      securityContext:
+        runAsUser: 2000
+      containers:
+      - name: api
+        image: api
+        securityContext:
+          privileged: true
+`
+
+func TestMutateManifest(t *testing.T) {
+	policy = defaultPolicyConfig()
+	options := mutateOptions{namespace: "default", output: mutateOutputManifest}
+	var out, errOut bytes.Buffer
+	require.NoError(t, options.run(nil, strings.NewReader(mutateManifests), &out, &errOut))
+	require.Equal(t, "Warning: Deployment prod/api: privileged=true was removed from container \"api\"\n", errOut.String())
+
+	documents := strings.Split(out.String(), "---\n")[1:]
+	require.Len(t, documents, 3)
+	var pod corev1.Pod
+	require.NoError(t, yaml.Unmarshal([]byte(documents[0]), &pod))
+	require.Equal(t, int64(1000), *pod.Spec.SecurityContext.RunAsUser)
+	var service corev1.Service
+	require.NoError(t, yaml.Unmarshal([]byte(documents[1]), &service))
+	require.Equal(t, int32(80), service.Spec.Ports[0].Port)
+	var deployment appsv1.Deployment
+	require.NoError(t, yaml.Unmarshal([]byte(documents[2]), &deployment))
+	require.Equal(t, int64(2000), *deployment.Spec.Template.Spec.SecurityContext.FSGroup)
+	require.Nil(t, deployment.Spec.Template.Spec.Containers[0].SecurityContext.Privileged)
+}
+
+func TestMutatePatchAndDiff(t *testing.T) {
+	policy = defaultPolicyConfig()
+	options := mutateOptions{namespace: "default", output: mutateOutputPatch}
+	var out bytes.Buffer
+	require.NoError(t, options.run(nil, strings.NewReader(mutateManifests), &out, &bytes.Buffer{}))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Equal(t, []string{"# stdin: Pod web", "# stdin: Deployment prod/api"}, []string{lines[0], lines[2]})
+	var patches []jsonPatch
+	require.NoError(t, json.Unmarshal([]byte(lines[3]), &patches))
+	require.Equal(t, jsonPatch{Op: "add", Path: "/spec/template/spec/securityContext/fsGroup", Value: json.RawMessage("2000")}, patches[0])
+
+	out.Reset()
+	options.output = mutateOutputDiff
+	options.exitCode = true
+	err := options.run(nil, strings.NewReader(mutateManifests), &out, &bytes.Buffer{})
+	require.ErrorIs(t, err, errManifestsMutated)
+	require.Contains(t, out.String(), "+++ stdin (Pod web, mutated)\n")
+	require.Contains(t, out.String(), "\n-          privileged: true\n")
+	require.NotContains(t, out.String(), "Service")
+
+	// Manifests without pods pass the check
+	out.Reset()
+	require.NoError(t, options.run(nil, strings.NewReader("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\n"), &out, &bytes.Buffer{}))
+	require.Empty(t, out.String())
+
+	options.output = "json"
+	require.Error(t, options.run(nil, strings.NewReader(mutateManifests), &out, &bytes.Buffer{}))
+}
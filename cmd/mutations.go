@@ -0,0 +1,675 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	v1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+// Targets of the mutation actions
+const (
+	targetPod        = "pod"
+	targetContainers = "containers"
+)
+
+// mutationSpec is a mutation rule declared in the policy
+type mutationSpec struct {
+	// Name identifies the rule in the audit annotations, the metrics
+	// and the rules and disabledRules settings
+	Name string `json:"name"`
+	// Match restricts the pods the rule applies to, all of them if nil
+	Match *mutationMatch `json:"match,omitempty"`
+	// Builtin runs one of the built-in rules instead of Actions
+	Builtin string `json:"builtin,omitempty"`
+	// Actions are applied in order
+	Actions []mutationAction `json:"actions,omitempty"`
+	// FailurePolicy tells what to do when an expression of the rule fails
+	// or returns an invalid value: Ignore, the default, does not apply the
+	// rule or uses the next value source, and Fail rejects the pod.
+	FailurePolicy admissionregistrationv1.FailurePolicyType `json:"failurePolicy,omitempty"`
+}
+
+// mutationMatch lists the conditions a pod must meet, all of them
+type mutationMatch struct {
+	// Namespaces the pod must be in, any of them
+	Namespaces []string `json:"namespaces,omitempty"`
+	// ExcludeNamespaces the pod must not be in
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty"`
+	// Labels selects the pods by their labels
+	Labels *metav1.LabelSelector `json:"labels,omitempty"`
+	// Images any of the containers must match. Container actions only
+	// apply to the matching containers. "*" matches any sequence of characters.
+	Images []imagePattern `json:"images,omitempty"`
+	// Operations of the admission request, any of them
+	Operations []v1.Operation `json:"operations,omitempty"`
+	// Expression is a CEL expression that must return true
+	Expression string `json:"expression,omitempty"`
+}
+
+// mutationAction is a single change made by a rule. Exactly one of
+// SetIfAbsent, Force, DropCapability or AddLabel must be set.
+type mutationAction struct {
+	// Target is the object field paths are relative to, "pod" or
+	// "containers". Defaults to "containers" for DropCapability and
+	// "pod" for the other actions.
+	Target string `json:"target,omitempty"`
+	// SetIfAbsent sets the field if it is not defined
+	SetIfAbsent *fieldValue `json:"setIfAbsent,omitempty"`
+	// Force sets the field, or removes it if the value is null
+	Force *fieldValue `json:"force,omitempty"`
+	// DropCapability adds the capability to the container drop list
+	DropCapability corev1.Capability `json:"dropCapability,omitempty"`
+	// AddLabel sets a pod label
+	AddLabel *labelValue `json:"addLabel,omitempty"`
+}
+
+// fieldValue is the value an action assigns to a field
+type fieldValue struct {
+	// Field is a dot separated path of JSON field names,
+	// e.g. spec.securityContext.runAsUser
+	Field string `json:"field"`
+	// Value is the literal value of the field
+	Value json.RawMessage `json:"value,omitempty"`
+	// ValueFrom takes the value from other fields or the policy
+	ValueFrom *valueSource `json:"valueFrom,omitempty"`
+}
+
+// valueSource takes the value from the first source defined
+type valueSource struct {
+	// Fields of the target, as they were before the rule was applied
+	Fields []string `json:"fields,omitempty"`
+	// Expression is a CEL expression computing the value. A null
+	// result or an evaluation error leave the value undefined.
+	Expression string `json:"expression,omitempty"`
+	// Policy is the name of a policy setting, e.g. runAsUser. Namespace
+	// ranges are applied.
+	Policy string `json:"policy,omitempty"`
+}
+
+// labelValue is a pod label
+type labelValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// actionFunc applies an action to the JSON representation of the target.
+// original is the target before the rule.
+type actionFunc func(obj, original map[string]interface{}, rc *ruleContext) error
+
+// expressionErrors handles the errors of the expressions of a rule
+type expressionErrors struct {
+	rule string
+	fail bool
+}
+
+// handle counts the error, and returns it if the rule must fail.
+// kind is the part of the rule the expression belongs to.
+func (e expressionErrors) handle(kind string, err error) error {
+	ruleExpressionErrors.WithLabelValues(e.rule, kind).Inc()
+	if e.fail {
+		return fmt.Errorf("rule %s: %w", e.rule, err)
+	}
+	klog.V(2).Infof("rule %s: ignoring %s expression error: %v", e.rule, kind, err)
+	return nil
+}
+
+// valueFunc resolves the value of a fieldValue
+type valueFunc func(original map[string]interface{}, rc *ruleContext) (interface{}, bool, error)
+
+// compileMutations turns the mutations declared in the policy into rules.
+// builtins are the rules the mutations can run by name.
+func compileMutations(specs []mutationSpec, builtins ruleSet) (ruleSet, error) {
+	var errs []error
+	rules := make(ruleSet, 0, len(specs))
+	for idx, spec := range specs {
+		rule, err := spec.compile(builtins)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("mutations[%d] %q: %w", idx, spec.Name, err))
+			continue
+		}
+		if _, ok := rules.find(rule.name); ok {
+			errs = append(errs, fmt.Errorf("mutations[%d]: rule %q is declared more than once", idx, rule.name))
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, errors.Join(errs...)
+}
+
+// compile checks the spec and builds the rule
+func (spec mutationSpec) compile(builtins ruleSet) (mutationRule, error) {
+	if errs := validation.IsDNS1123Label(spec.Name); len(errs) > 0 {
+		return mutationRule{}, fmt.Errorf("invalid name: %s", strings.Join(errs, ", "))
+	}
+	match, images, condition, err := spec.Match.compile()
+	if err != nil {
+		return mutationRule{}, fmt.Errorf("match: %w", err)
+	}
+	onError := expressionErrors{rule: spec.Name}
+	switch spec.FailurePolicy {
+	case "", admissionregistrationv1.Ignore:
+	case admissionregistrationv1.Fail:
+		onError.fail = true
+	default:
+		return mutationRule{}, fmt.Errorf("unsupported failurePolicy %q, must be %s or %s", spec.FailurePolicy, admissionregistrationv1.Ignore, admissionregistrationv1.Fail)
+	}
+	rule := mutationRule{name: spec.Name, filter: match}
+	switch {
+	case spec.Builtin != "" && len(spec.Actions) > 0:
+		return rule, errors.New("builtin and actions are mutually exclusive")
+	case spec.Builtin != "":
+		builtin, ok := builtins.find(spec.Builtin)
+		if !ok {
+			return rule, fmt.Errorf("unknown builtin %q, must be one of %v", spec.Builtin, builtins.names())
+		}
+		rule.filter = allFilters(match, builtin.filter)
+		rule.pod, rule.container = builtin.pod, builtin.container
+		// the rules of the default policy are bound to each request too
+		if condition != nil || builtin.bind != nil {
+			unbound := rule
+			rule.bind = func(rc *ruleContext) (mutationRule, bool, error) {
+				if condition != nil {
+					if matched, err := rc.matches(condition, onError); !matched || err != nil {
+						return mutationRule{}, false, err
+					}
+				}
+				if builtin.bind == nil {
+					return unbound, true, nil
+				}
+				bound, ok, err := builtin.bind(rc)
+				bound.name, bound.filter = unbound.name, unbound.filter
+				return bound, ok, err
+			}
+		}
+		return rule, nil
+	case len(spec.Actions) == 0:
+		return rule, errors.New("either builtin or actions is required")
+	}
+	var podActions, containerActions []actionFunc
+	for idx, action := range spec.Actions {
+		target, f, err := action.compile(onError)
+		if err != nil {
+			return rule, fmt.Errorf("actions[%d]: %w", idx, err)
+		}
+		if target == targetPod {
+			podActions = append(podActions, f)
+		} else {
+			containerActions = append(containerActions, f)
+		}
+	}
+	// The unbound rule only tells the phases it runs in, for ruleSet.checkOrder.
+	// Actions read the policy values and CEL variables of the request.
+	if len(podActions) > 0 {
+		rule.pod = func(*corev1.Pod, *patchSet) error { return errUnbound }
+	}
+	if len(containerActions) > 0 {
+		rule.container = func(string, *corev1.Container, *patchSet) error { return errUnbound }
+	}
+	rule.bind = func(rc *ruleContext) (mutationRule, bool, error) {
+		if condition != nil {
+			if matched, err := rc.matches(condition, onError); !matched || err != nil {
+				return mutationRule{}, false, err
+			}
+		}
+		bound := mutationRule{name: rule.name, filter: rule.filter}
+		if len(podActions) > 0 {
+			bound.pod = func(pod *corev1.Pod, ps *patchSet) error {
+				return applyActions(pod, podActions, rc)
+			}
+		}
+		if len(containerActions) > 0 {
+			bound.container = func(path string, container *corev1.Container, ps *patchSet) error {
+				if len(images) > 0 && !slices.ContainsFunc(images, func(pattern imagePattern) bool { return pattern.match(container.Image) }) {
+					return nil
+				}
+				return applyActions(container, containerActions, rc)
+			}
+		}
+		return bound, true, nil
+	}
+	return rule, nil
+}
+
+// matches evaluates the match expression of the rule. Rules whose
+// expression fails do not apply, unless their failure policy is Fail.
+func (rc *ruleContext) matches(condition *celProgram, onError expressionErrors) (bool, error) {
+	vars, err := rc.vars()
+	if err != nil {
+		return false, err
+	}
+	matched, err := condition.evalBool(vars)
+	if err != nil {
+		return false, onError.handle("match", err)
+	}
+	return matched, nil
+}
+
+// compile returns the filter, the image patterns and the CEL condition
+// of the match, nil if there are no conditions
+func (m *mutationMatch) compile() (podFilterFunc, []imagePattern, *celProgram, error) {
+	if m == nil {
+		return nil, nil, nil, nil
+	}
+	var errs []error
+	var condition *celProgram
+	if m.Expression != "" {
+		var err error
+		if condition, err = compileCELCondition(m.Expression); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	var selector labels.Selector
+	if m.Labels != nil {
+		var err error
+		if selector, err = metav1.LabelSelectorAsSelector(m.Labels); err != nil {
+			errs = append(errs, fmt.Errorf("labels: %w", err))
+		}
+	}
+	for _, image := range m.Images {
+		if image.pattern == "" {
+			errs = append(errs, errors.New("image pattern must not be empty"))
+		}
+	}
+	for _, operation := range m.Operations {
+		switch operation {
+		case v1.Create, v1.Update, v1.Delete, v1.Connect:
+		default:
+			errs = append(errs, fmt.Errorf("unsupported operation %q", operation))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, nil, nil, errors.Join(errs...)
+	}
+	namespaces := slices.Clone(m.Namespaces)
+	excluded := slices.Clone(m.ExcludeNamespaces)
+	images := slices.Clone(m.Images)
+	operations := slices.Clone(m.Operations)
+	filter := func(req *v1.AdmissionRequest, pod *corev1.Pod) bool {
+		if len(namespaces) > 0 && !slices.Contains(namespaces, pod.Namespace) {
+			return false
+		}
+		if slices.Contains(excluded, pod.Namespace) {
+			return false
+		}
+		if selector != nil && !selector.Matches(labels.Set(pod.Labels)) {
+			return false
+		}
+		if len(images) > 0 && !slices.ContainsFunc(podImages(pod), func(image string) bool {
+			return slices.ContainsFunc(images, func(pattern imagePattern) bool { return pattern.match(image) })
+		}) {
+			return false
+		}
+		if len(operations) > 0 && (req == nil || !slices.Contains(operations, req.Operation)) {
+			return false
+		}
+		return true
+	}
+	return filter, images, condition, nil
+}
+
+// compile checks the action and returns its target and function
+func (a mutationAction) compile(onError expressionErrors) (string, actionFunc, error) {
+	set := 0
+	for _, isSet := range []bool{a.SetIfAbsent != nil, a.Force != nil, a.DropCapability != "", a.AddLabel != nil} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return "", nil, errors.New("exactly one of setIfAbsent, force, dropCapability or addLabel must be set")
+	}
+	target := a.Target
+	if target == "" {
+		target = targetPod
+		if a.DropCapability != "" {
+			target = targetContainers
+		}
+	}
+	if target != targetPod && target != targetContainers {
+		return "", nil, fmt.Errorf("unsupported target %q, must be %s or %s", target, targetPod, targetContainers)
+	}
+	switch {
+	case a.SetIfAbsent != nil:
+		path, value, err := a.SetIfAbsent.compile(target, onError)
+		if err != nil {
+			return "", nil, fmt.Errorf("setIfAbsent: %w", err)
+		}
+		return target, func(obj, original map[string]interface{}, rc *ruleContext) error {
+			if current, ok := path.get(obj); ok && current != nil {
+				return nil
+			}
+			v, ok, err := value(original, rc)
+			if ok && v != nil {
+				path.set(obj, v)
+			}
+			return err
+		}, nil
+	case a.Force != nil:
+		path, value, err := a.Force.compile(target, onError)
+		if err != nil {
+			return "", nil, fmt.Errorf("force: %w", err)
+		}
+		return target, func(obj, original map[string]interface{}, rc *ruleContext) error {
+			v, ok, err := value(original, rc)
+			switch {
+			case !ok:
+			case v == nil:
+				path.remove(obj)
+			default:
+				path.set(obj, v)
+			}
+			return err
+		}, nil
+	case a.DropCapability != "":
+		if target != targetContainers {
+			return "", nil, fmt.Errorf("dropCapability only applies to %s", targetContainers)
+		}
+		path := fieldPath{"securityContext", "capabilities", "drop"}
+		capability := string(a.DropCapability)
+		return target, func(obj, original map[string]interface{}, rc *ruleContext) error {
+			current, _ := path.get(obj)
+			drop, _ := current.([]interface{})
+			if !slices.Contains(drop, interface{}(capability)) {
+				path.set(obj, append(slices.Clone(drop), capability))
+			}
+			return nil
+		}, nil
+	default:
+		if target != targetPod {
+			return "", nil, fmt.Errorf("addLabel only applies to the %s", targetPod)
+		}
+		if errs := validation.IsQualifiedName(a.AddLabel.Key); len(errs) > 0 {
+			return "", nil, fmt.Errorf("addLabel: invalid key %q: %s", a.AddLabel.Key, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsValidLabelValue(a.AddLabel.Value); len(errs) > 0 {
+			return "", nil, fmt.Errorf("addLabel: invalid value %q: %s", a.AddLabel.Value, strings.Join(errs, ", "))
+		}
+		path := fieldPath{"metadata", "labels", a.AddLabel.Key}
+		value := a.AddLabel.Value
+		return target, func(obj, original map[string]interface{}, rc *ruleContext) error {
+			path.set(obj, value)
+			return nil
+		}, nil
+	}
+}
+
+// compile checks the field and the value are valid for the target
+func (fv fieldValue) compile(target string, onError expressionErrors) (fieldPath, valueFunc, error) {
+	path, err := parseFieldPath(fv.Field)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case len(fv.Value) > 0 && fv.ValueFrom != nil:
+		return nil, nil, errors.New("value and valueFrom are mutually exclusive")
+	case len(fv.Value) > 0:
+		value, err := toJSONValue(fv.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := validateField(target, path, value); err != nil {
+			return nil, nil, err
+		}
+		return path, func(original map[string]interface{}, rc *ruleContext) (interface{}, bool, error) {
+			return runtime.DeepCopyJSONValue(value), true, nil
+		}, nil
+	case fv.ValueFrom != nil:
+		value, err := fv.ValueFrom.compile(target, path, onError)
+		return path, value, err
+	default:
+		return nil, nil, errors.New("either value or valueFrom is required")
+	}
+}
+
+// compile checks the sources exist and, for policy settings, that their
+// value is valid for the field at path
+func (vs valueSource) compile(target string, path fieldPath, onError expressionErrors) (valueFunc, error) {
+	if len(vs.Fields) == 0 && vs.Expression == "" && vs.Policy == "" {
+		return nil, errors.New("valueFrom requires fields, expression or policy")
+	}
+	var errs []error
+	sources := make([]fieldPath, 0, len(vs.Fields))
+	for _, field := range vs.Fields {
+		source, err := parseFieldPath(field)
+		if err == nil {
+			err = validateField(target, source, nil)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sources = append(sources, source)
+	}
+	var expression *celProgram
+	if vs.Expression != "" {
+		var err error
+		if expression, err = compileCEL(vs.Expression); err != nil {
+			errs = append(errs, err)
+		} else if sample, ok := expression.sample(); ok {
+			if err := validateField(target, path, sample); err != nil {
+				errs = append(errs, fmt.Errorf("expression %q returns %s: %w", vs.Expression, expression.output, err))
+			}
+		}
+	}
+	if vs.Policy != "" {
+		defaults, err := policyValues("")
+		if err != nil {
+			return nil, err
+		}
+		if value, ok := defaults[vs.Policy]; !ok {
+			errs = append(errs, fmt.Errorf("unknown policy setting %q", vs.Policy))
+		} else if err := validateField(target, path, value); err != nil {
+			errs = append(errs, fmt.Errorf("policy setting %q: %w", vs.Policy, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	policySetting := vs.Policy
+	return func(original map[string]interface{}, rc *ruleContext) (interface{}, bool, error) {
+		for _, source := range sources {
+			if value, ok := source.get(original); ok && value != nil {
+				return runtime.DeepCopyJSONValue(value), true, nil
+			}
+		}
+		if expression != nil {
+			// expressions usually fail when an annotation is missing,
+			// and then the next source is used. Objects, lists and maps
+			// are only checked against the field once evaluated.
+			value, err := evalValue(expression, rc)
+			if err == nil && value != nil {
+				err = validateField(target, path, value)
+			}
+			switch {
+			case err != nil:
+				if err := onError.handle("value", err); err != nil {
+					return nil, false, err
+				}
+			case value != nil:
+				return value, true, nil
+			}
+		}
+		if policySetting == "" {
+			return nil, false, nil
+		}
+		values, err := rc.values()
+		if err != nil {
+			return nil, false, err
+		}
+		value, ok := values[policySetting]
+		return runtime.DeepCopyJSONValue(value), ok, nil
+	}, nil
+}
+
+// evalValue runs a value expression with the variables of the request
+func evalValue(expression *celProgram, rc *ruleContext) (interface{}, error) {
+	vars, err := rc.vars()
+	if err != nil {
+		return nil, err
+	}
+	return expression.evalJSON(vars)
+}
+
+// policyValues returns the JSON representation of the policy settings
+// for the namespace
+func policyValues(namespace string) (map[string]interface{}, error) {
+	value, err := toJSONValue(policyForNamespace(namespace))
+	if err != nil {
+		return nil, err
+	}
+	values, _ := value.(map[string]interface{})
+	return values, nil
+}
+
+// validateField checks that value can be assigned to the field at path
+// of an empty target object. A nil value only checks the field exists.
+func validateField(target string, path fieldPath, value interface{}) error {
+	obj := make(map[string]interface{})
+	path.set(obj, value)
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var into interface{} = &corev1.Pod{}
+	if target == targetContainers {
+		into = &corev1.Container{}
+	}
+	if err := decoder.Decode(into); err != nil {
+		return fmt.Errorf("invalid field %s: %w", strings.Join(path, "."), err)
+	}
+	return nil
+}
+
+// applyActions runs the actions over the JSON representation of the
+// target, and replaces it with the result if anything changed
+func applyActions[T any](target *T, actions []actionFunc, rc *ruleContext) error {
+	original, err := toJSONValue(target)
+	if err != nil {
+		return err
+	}
+	current, err := toJSONValue(target)
+	if err != nil {
+		return err
+	}
+	obj, ok := current.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("unexpected type %T", current)
+	}
+	for _, action := range actions {
+		if err := action(obj, original.(map[string]interface{}), rc); err != nil {
+			return err
+		}
+	}
+	if reflect.DeepEqual(original, current) {
+		return nil
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	var result T
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	*target = result
+	return nil
+}
+
+// allFilters returns a filter matching the pods all the filters match.
+// nil filters are ignored.
+func allFilters(filters ...podFilterFunc) podFilterFunc {
+	filters = slices.DeleteFunc(filters, func(filter podFilterFunc) bool { return filter == nil })
+	if len(filters) == 0 {
+		return nil
+	}
+	return func(req *v1.AdmissionRequest, pod *corev1.Pod) bool {
+		for _, filter := range filters {
+			if !filter(req, pod) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// fieldPath is a path of JSON field names
+type fieldPath []string
+
+// parseFieldPath parses a dot separated field path
+func parseFieldPath(path string) (fieldPath, error) {
+	segments := strings.Split(path, ".")
+	if slices.Contains(segments, "") {
+		return nil, fmt.Errorf("invalid field path %q", path)
+	}
+	return segments, nil
+}
+
+// get returns the value at path, if defined
+func (p fieldPath) get(obj map[string]interface{}) (interface{}, bool) {
+	var current interface{} = obj
+	for _, segment := range p {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[segment]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// set assigns the value at path, creating the missing objects
+func (p fieldPath) set(obj map[string]interface{}, value interface{}) {
+	for _, segment := range p[:len(p)-1] {
+		next, ok := obj[segment].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			obj[segment] = next
+		}
+		obj = next
+	}
+	obj[p[len(p)-1]] = value
+}
+
+// remove deletes the value at path, if defined
+func (p fieldPath) remove(obj map[string]interface{}) {
+	var parent interface{} = obj
+	if len(p) > 1 {
+		parent, _ = p[:len(p)-1].get(obj)
+	}
+	if m, ok := parent.(map[string]interface{}); ok {
+		delete(m, p[len(p)-1])
+	}
+}
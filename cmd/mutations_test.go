@@ -0,0 +1,302 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testHardeningPolicy = `
+apiVersion: think8shook.io/v1alpha1
+kind: HardeningPolicy
+metadata:
+  name: test
+spec:
+  runAsUser: 2000
+  mutations:
+  - name: uid
+    match:
+      namespaces: [apps]
+      operations: [CREATE]
+    actions:
+    - setIfAbsent:
+        field: spec.securityContext.runAsUser
+        valueFrom:
+          policy: runAsUser
+    - addLabel:
+        key: think8shook.io/hardened
+        value: "true"
+  - name: no-host-network
+    match:
+      labels:
+        matchExpressions:
+        - {key: tier, operator: NotIn, values: [infra]}
+    actions:
+    - force:
+        field: spec.hostNetwork
+        value: null
+  - name: nginx
+    match:
+      images: ["nginx:*"]
+    actions:
+    - dropCapability: NET_RAW
+    - target: containers
+      setIfAbsent:
+        field: securityContext.readOnlyRootFilesystem
+        value: true
+`
+
+func loadTestPolicy(t *testing.T, content string) (policyConfig, error) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var flags policyConfig
+	var file string
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	addPolicyFlags(fs, &flags, &file)
+	return loadPolicyConfig(path, fs, flags)
+}
+
+func TestDeclarativeMutations(t *testing.T) {
+	cfg, err := loadTestPolicy(t, testHardeningPolicy)
+	require.NoError(t, err)
+	require.Equal(t, int64(2000), cfg.RunAsUser)
+	require.Equal(t, []string{"uid", "no-host-network", "nginx"}, cfg.enabledRules().names())
+	defer func() { policy = defaultPolicyConfig() }()
+	policy = cfg
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "apps", Labels: map[string]string{"tier": "web"}},
+		Spec: corev1.PodSpec{
+			HostNetwork: true,
+			Containers: []corev1.Container{
+				{Name: "web", Image: "nginx:1.27"},
+				{Name: "sidecar", Image: "envoy:1.30"},
+			},
+		},
+	}
+	testCases := []struct {
+		name      string
+		namespace string
+		operation v1.Operation
+		labels    map[string]string
+		paths     []string
+		applied   string
+	}{
+		{
+			name:      "all rules",
+			namespace: "apps",
+			operation: v1.Create,
+			labels:    map[string]string{"tier": "web"},
+			paths: []string{
+				"/metadata/labels/think8shook.io~1hardened",
+				"/spec/hostNetwork",
+				"/spec/securityContext",
+				"/spec/containers/0/securityContext",
+			},
+			applied: "uid,no-host-network,nginx",
+		},
+		{
+			name:      "other namespace",
+			namespace: "default",
+			operation: v1.Create,
+			labels:    map[string]string{"tier": "web"},
+			paths:     []string{"/spec/hostNetwork", "/spec/containers/0/securityContext"},
+			applied:   "no-host-network,nginx",
+		},
+		{
+			name:      "update",
+			namespace: "apps",
+			operation: v1.Update,
+			labels:    map[string]string{"tier": "infra"},
+			paths:     []string{"/spec/containers/0/securityContext"},
+			applied:   "nginx",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := pod.DeepCopy()
+			pod.Namespace = tc.namespace
+			pod.Labels = tc.labels
+			raw := mustMarshal(pod)
+			req := &v1.AdmissionRequest{Namespace: tc.namespace, Operation: tc.operation}
+			ps := &patchSet{}
+			require.NoError(t, mutateRules(req, pod, ps))
+			paths := make([]string, 0, len(ps.patches))
+			for _, patch := range ps.patches {
+				paths = append(paths, patch.Path)
+			}
+			require.Equal(t, tc.paths, paths)
+			require.Equal(t, tc.applied, ps.auditAnnotations()[rulesAuditKey])
+
+			mutated := mustApply(t, raw, ps)
+			require.Equal(t, &corev1.SecurityContext{
+				ReadOnlyRootFilesystem: &[]bool{true}[0],
+				Capabilities:           &corev1.Capabilities{Drop: []corev1.Capability{"NET_RAW"}},
+			}, mutated.Spec.Containers[0].SecurityContext)
+			require.Nil(t, mutated.Spec.Containers[1].SecurityContext)
+		})
+	}
+}
+
+func TestDeclarativeMutationErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		mutation string
+		err      string
+	}{
+		{
+			name:     "unknown field",
+			mutation: "{name: test, actions: [{force: {field: spec.securityContext.runAsUserID, value: 1}}]}",
+			err:      "invalid field spec.securityContext.runAsUserID",
+		},
+		{
+			name:     "wrong type",
+			mutation: "{name: test, actions: [{force: {field: spec.securityContext.runAsUser, value: root}}]}",
+			err:      "invalid field spec.securityContext.runAsUser",
+		},
+		{
+			name:     "container field on the pod",
+			mutation: "{name: test, actions: [{setIfAbsent: {field: securityContext.privileged, value: false}}]}",
+			err:      "invalid field securityContext.privileged",
+		},
+		{
+			name:     "unknown policy setting",
+			mutation: "{name: test, actions: [{setIfAbsent: {field: spec.securityContext.runAsUser, valueFrom: {policy: uid}}}]}",
+			err:      `unknown policy setting "uid"`,
+		},
+		{
+			name:     "policy setting of another type",
+			mutation: "{name: test, actions: [{setIfAbsent: {field: spec.securityContext.runAsUser, valueFrom: {policy: seccompProfile}}}]}",
+			err:      `policy setting "seccompProfile"`,
+		},
+		{
+			name:     "several actions",
+			mutation: "{name: test, actions: [{dropCapability: ALL, addLabel: {key: a, value: b}}]}",
+			err:      "exactly one of",
+		},
+		{
+			name:     "pod capabilities",
+			mutation: "{name: test, actions: [{target: pod, dropCapability: ALL}]}",
+			err:      "dropCapability only applies to containers",
+		},
+		{
+			name:     "unknown builtin",
+			mutation: "{name: test, builtin: no-such-rule}",
+			err:      `unknown builtin "no-such-rule"`,
+		},
+		{
+			name:     "builtin and actions",
+			mutation: "{name: test, builtin: drop-capabilities, actions: [{dropCapability: ALL}]}",
+			err:      "mutually exclusive",
+		},
+		{
+			name:     "invalid operation",
+			mutation: "{name: test, match: {operations: [PATCH]}, builtin: drop-capabilities}",
+			err:      `unsupported operation "PATCH"`,
+		},
+		{
+			name:     "invalid name",
+			mutation: "{name: Test_Rule, builtin: drop-capabilities}",
+			err:      "invalid name",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			content := "apiVersion: think8shook.io/v1alpha1\nkind: HardeningPolicy\nspec:\n  mutations:\n  - " + tc.mutation + "\n"
+			_, err := loadTestPolicy(t, content)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestHardeningPolicyDecoding(t *testing.T) {
+	_, err := loadTestPolicy(t, "apiVersion: think8shook.io/v1alpha1\nkind: HardeningPolicy\nspec:\n  runAsUserID: 1000\n")
+	require.ErrorContains(t, err, "runAsUserID")
+	_, err = loadTestPolicy(t, "apiVersion: think8shook.io/v1\nkind: HardeningPolicy\nspec: {}\n")
+	require.ErrorContains(t, err, "no kind")
+	_, err = loadTestPolicy(t, "apiVersion: v1\nkind: Pod\nspec: {}\n")
+	require.ErrorContains(t, err, "expected think8shook.io/v1alpha1, Kind=HardeningPolicy")
+	// Rules refer to the declared mutations
+	_, err = loadTestPolicy(t, testHardeningPolicy+"  rules: [uid, pod-identity]\n")
+	require.ErrorContains(t, err, `unknown mutation rule "pod-identity"`)
+}
+
+func TestDefaultRulesAsBuiltins(t *testing.T) {
+	cfg, err := loadTestPolicy(t, `
+apiVersion: think8shook.io/v1alpha1
+kind: HardeningPolicy
+spec:
+  mutations:
+  - name: identity
+    match:
+      namespaces: [apps]
+    builtin: pod-identity
+  - name: seccomp-profile
+    builtin: seccomp-profile
+`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"identity", "seccomp-profile"}, cfg.enabledRules().names())
+	defer func() { policy = defaultPolicyConfig() }()
+	policy = cfg
+
+	for _, namespace := range []string{"apps", "default"} {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: namespace},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "test"}}},
+		}
+		raw := mustMarshal(pod)
+		ps := &patchSet{}
+		require.NoError(t, mutateRules(&v1.AdmissionRequest{Namespace: namespace}, pod, ps))
+		mutated := mustApply(t, raw, ps)
+		require.Equal(t, &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}, mutated.Spec.SecurityContext.SeccompProfile)
+		if namespace == "apps" {
+			require.Equal(t, "identity,seccomp-profile", ps.auditAnnotations()[rulesAuditKey])
+			require.Equal(t, &[]int64{InjectedUID}[0], mutated.Spec.SecurityContext.RunAsUser)
+		} else {
+			require.Equal(t, "seccomp-profile", ps.auditAnnotations()[rulesAuditKey])
+			require.Nil(t, mutated.Spec.SecurityContext.RunAsUser)
+		}
+	}
+}
+
+func TestHardeningPolicyDeepCopy(t *testing.T) {
+	cfg, err := loadTestPolicy(t, testHardeningPolicy)
+	require.NoError(t, err)
+	original := &HardeningPolicy{ObjectMeta: metav1.ObjectMeta{Name: "test"}, Spec: cfg}
+	copied, ok := original.DeepCopyObject().(*HardeningPolicy)
+	require.True(t, ok)
+	require.Equal(t, original.Spec.enabledRules().names(), copied.Spec.enabledRules().names())
+	require.Len(t, copied.Spec.compiled, len(original.Spec.compiled))
+
+	// The copy does not share the mutable fields
+	copied.Spec.Mutations[0].Match.Namespaces[0] = "other"
+	copied.Spec.Mutations[0].Actions[0].SetIfAbsent.ValueFrom.Policy = "fsGroup"
+	copied.Spec.Exemptions.NamespaceLabels["other"] = "true"
+	require.Equal(t, []string{"apps"}, original.Spec.Mutations[0].Match.Namespaces)
+	require.Equal(t, "runAsUser", original.Spec.Mutations[0].Actions[0].SetIfAbsent.ValueFrom.Policy)
+	require.NotContains(t, original.Spec.Exemptions.NamespaceLabels, "other")
+}
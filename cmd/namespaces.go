@@ -0,0 +1,207 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// Namespace annotations with the ranges of ids assigned to the namespace,
+// in the same "start/size" format used by openshift.io/sa.scc.uid-range.
+const (
+	UIDRangeAnnotation     = "think8shook.io/uid-range"
+	GIDRangeAnnotation     = "think8shook.io/gid-range"
+	FSGroupRangeAnnotation = "think8shook.io/fsgroup-range"
+)
+
+// namespaceLister is used to look up per-namespace defaults and exemptions.
+// It is nil when neither of them is enabled.
+var namespaceLister corelisters.NamespaceLister
+
+// maxID is the highest uid / gid accepted by the API server
+const maxID = math.MaxInt32
+
+// idRange is a range of ids, [start, start+size). Only start is injected,
+// size is used to report pods with explicit ids outside the range.
+type idRange struct {
+	start int64
+	size  int64
+}
+
+// parseIDRange parses a range in "start/size" format
+func parseIDRange(value string) (idRange, error) {
+	start, size, found := strings.Cut(strings.TrimSpace(value), "/")
+	if !found {
+		return idRange{}, fmt.Errorf("range %q must have format start/size", value)
+	}
+	var (
+		r   idRange
+		err error
+	)
+	if r.start, err = strconv.ParseInt(start, 10, 64); err != nil {
+		return idRange{}, fmt.Errorf("invalid start in range %q: %w", value, err)
+	}
+	if r.size, err = strconv.ParseInt(size, 10, 64); err != nil {
+		return idRange{}, fmt.Errorf("invalid size in range %q: %w", value, err)
+	}
+	if r.start < 0 || r.size <= 0 {
+		return idRange{}, fmt.Errorf("range %q must have non-negative start and positive size", value)
+	}
+	// compared without adding, so that start+size cannot overflow
+	if r.start > maxID || r.size > maxID-r.start+1 {
+		return idRange{}, fmt.Errorf("range %q exceeds the maximum id %d", value, maxID)
+	}
+	return r, nil
+}
+
+// contains returns true if id is in the range
+func (r idRange) contains(id int64) bool {
+	return id >= r.start && id-r.start < r.size
+}
+
+func (r idRange) String() string {
+	return fmt.Sprintf("%d/%d", r.start, r.size)
+}
+
+// namespaceRanges returns the ranges of ids of the namespace, keyed by
+// annotation. Group ranges fall back to the uid range, and fsGroup to
+// the group range.
+func namespaceRanges(namespace string) map[string]idRange {
+	if namespaceLister == nil || namespace == "" {
+		return nil
+	}
+	ns, err := namespaceLister.Get(namespace)
+	if err != nil {
+		klog.Errorf("failed to get namespace %s, using global defaults: %v", namespace, err)
+		return nil
+	}
+	ranges := make(map[string]idRange, 3)
+	for _, annotation := range []string{UIDRangeAnnotation, GIDRangeAnnotation, FSGroupRangeAnnotation} {
+		value, ok := ns.Annotations[annotation]
+		if !ok {
+			continue
+		}
+		r, err := parseIDRange(value)
+		if err != nil {
+			klog.Errorf("namespace %s has invalid annotation %s, ignoring: %v", namespace, annotation, err)
+			continue
+		}
+		ranges[annotation] = r
+	}
+	if _, ok := ranges[GIDRangeAnnotation]; !ok {
+		if r, ok := ranges[UIDRangeAnnotation]; ok {
+			ranges[GIDRangeAnnotation] = r
+		}
+	}
+	if _, ok := ranges[FSGroupRangeAnnotation]; !ok {
+		if r, ok := ranges[GIDRangeAnnotation]; ok {
+			ranges[FSGroupRangeAnnotation] = r
+		}
+	}
+	return ranges
+}
+
+// policyForNamespace returns the policy config with the defaults
+// overridden by the start of the namespace ranges, if any.
+func policyForNamespace(namespace string) policyConfig {
+	cfg := policy
+	ranges := namespaceRanges(namespace)
+	if r, ok := ranges[UIDRangeAnnotation]; ok {
+		cfg.RunAsUser = r.start
+	}
+	if r, ok := ranges[GIDRangeAnnotation]; ok {
+		cfg.RunAsGroup = r.start
+	}
+	if r, ok := ranges[FSGroupRangeAnnotation]; ok {
+		cfg.FSGroup = r.start
+	}
+	return cfg
+}
+
+// warnOutsideRanges logs the ids set explicitly by the pod that fall
+// outside the ranges of its namespace. The ids are kept, since the pod
+// may be allowed to use them by other means, e.g. an OpenShift SCC.
+func warnOutsideRanges(pod *corev1.Pod) {
+	ranges := namespaceRanges(pod.Namespace)
+	if len(ranges) == 0 {
+		return
+	}
+	check := func(field, annotation string, id *int64) {
+		if r, ok := ranges[annotation]; ok && id != nil && !r.contains(*id) {
+			klog.Warningf("pod %s/%s sets %s=%d outside the range %s of its namespace", pod.Namespace, pod.Name, field, *id, r)
+		}
+	}
+	if sc := pod.Spec.SecurityContext; sc != nil {
+		check("runAsUser", UIDRangeAnnotation, sc.RunAsUser)
+		check("runAsGroup", GIDRangeAnnotation, sc.RunAsGroup)
+		check("fsGroup", FSGroupRangeAnnotation, sc.FSGroup)
+	}
+	checkContainer := func(name string, sc *corev1.SecurityContext) {
+		if sc != nil {
+			check(fmt.Sprintf("container %q runAsUser", name), UIDRangeAnnotation, sc.RunAsUser)
+			check(fmt.Sprintf("container %q runAsGroup", name), GIDRangeAnnotation, sc.RunAsGroup)
+		}
+	}
+	for _, container := range pod.Spec.InitContainers {
+		checkContainer(container.Name, container.SecurityContext)
+	}
+	for _, container := range pod.Spec.Containers {
+		checkContainer(container.Name, container.SecurityContext)
+	}
+	for _, container := range pod.Spec.EphemeralContainers {
+		checkContainer(container.Name, container.SecurityContext)
+	}
+}
+
+// namespaceSyncTimeout bounds the initial sync of the namespace informer,
+// so that missing permissions fail the startup instead of hanging it.
+const namespaceSyncTimeout = time.Minute
+
+// startNamespaceInformer starts a namespace informer and waits
+// for its cache to sync.
+func startNamespaceInformer(ctx context.Context, client kubernetes.Interface) (corelisters.NamespaceLister, error) {
+	factory := informers.NewSharedInformerFactory(client, 10*time.Minute)
+	lister := factory.Core().V1().Namespaces().Lister()
+	informer := factory.Core().V1().Namespaces().Informer()
+	readinessChecks.add("informers", func() error {
+		if !informer.HasSynced() {
+			return errors.New("namespace informer not synced")
+		}
+		return nil
+	})
+	factory.Start(ctx.Done())
+	syncCtx, cancel := context.WithTimeout(ctx, namespaceSyncTimeout)
+	defer cancel()
+	for informer, synced := range factory.WaitForCacheSync(syncCtx.Done()) {
+		if !synced {
+			return nil, fmt.Errorf("failed to sync informer cache for %v", informer)
+		}
+	}
+	return lister, nil
+}
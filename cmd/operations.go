@@ -0,0 +1,105 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	podsResource = metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+	jobsResource = metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+)
+
+// isMutableOperation returns true if the request may carry patches.
+// Only CREATE and UPDATE of the object or its ephemeral containers qualify;
+// other subresources (status, binding...) are left alone.
+func isMutableOperation(req *v1.AdmissionRequest) bool {
+	switch req.Operation {
+	case v1.Create, v1.Update:
+	default:
+		return false
+	}
+	switch req.SubResource {
+	case "", ephemeralContainersSubresource:
+		return true
+	}
+	return false
+}
+
+// mutableOnUpdate returns a function that tells whether a patch path,
+// relative to the pod, can be applied to an UPDATE request without
+// the API server rejecting it. oldPod and pod must not be mutated yet.
+func mutableOnUpdate(req *v1.AdmissionRequest, oldPod, pod *corev1.Pod) func(path string) bool {
+	switch {
+	case req.SubResource == ephemeralContainersSubresource:
+		// Only the ephemeral containers added by this request can be changed
+		prefixes := make([]string, 0, 1)
+		for _, idx := range newEphemeralContainers(oldPod, pod) {
+			prefixes = append(prefixes, fmt.Sprintf("/spec/ephemeralContainers/%d/", idx))
+		}
+		return func(path string) bool {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(path, prefix) {
+					return true
+				}
+			}
+			return false
+		}
+	case req.Resource == podsResource:
+		// The spec of a running pod is immutable, but the metadata is not
+		return func(path string) bool {
+			return strings.HasPrefix(path, "/metadata/")
+		}
+	case req.Resource == jobsResource:
+		// The pod template of a job is immutable
+		return func(path string) bool {
+			return false
+		}
+	default:
+		// Workload templates are mutable, but patching a template the user
+		// has not changed would trigger an unexpected rollout
+		unchanged := apiequality.Semantic.DeepEqual(oldPod.Spec, pod.Spec) &&
+			apiequality.Semantic.DeepEqual(oldPod.Labels, pod.Labels) &&
+			apiequality.Semantic.DeepEqual(oldPod.Annotations, pod.Annotations)
+		return func(path string) bool {
+			return !unchanged
+		}
+	}
+}
+
+// newEphemeralContainers returns the indexes of the ephemeral containers
+// in pod that were not present in oldPod
+func newEphemeralContainers(oldPod, pod *corev1.Pod) []int {
+	existing := make(map[string]bool, len(oldPod.Spec.EphemeralContainers))
+	for _, ec := range oldPod.Spec.EphemeralContainers {
+		existing[ec.Name] = true
+	}
+	indexes := make([]int, 0, 1)
+	for idx, ec := range pod.Spec.EphemeralContainers {
+		if !existing[ec.Name] {
+			indexes = append(indexes, idx)
+		}
+	}
+	return indexes
+}
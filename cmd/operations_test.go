@@ -0,0 +1,118 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/warpcomdev/think8shook/internal/webhook"
+	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestOperations(t *testing.T) {
+	root := int64(0)
+	podSpec := corev1.PodSpec{
+		SecurityContext: &corev1.PodSecurityContext{RunAsUser: &root},
+		Containers:      []corev1.Container{{Name: "test", Image: "busybox:1.0"}},
+	}
+	newPodSpec := *podSpec.DeepCopy()
+	newPodSpec.Containers[0].Image = "busybox:2.0"
+	labeled := metav1.ObjectMeta{Labels: map[string]string{"updated": "true"}}
+	deploymentsResource := metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+
+	testCases := []struct {
+		name      string
+		resource  metav1.GroupVersionResource
+		operation v1.Operation
+		oldObject interface{}
+		object    interface{}
+		patched   bool
+	}{
+		{
+			name:      "pod create",
+			resource:  podsResource,
+			operation: v1.Create,
+			object:    corev1.Pod{Spec: podSpec},
+			patched:   true,
+		},
+		{
+			name:      "pod update does not patch the immutable spec",
+			resource:  podsResource,
+			operation: v1.Update,
+			oldObject: corev1.Pod{Spec: podSpec},
+			object:    corev1.Pod{ObjectMeta: labeled, Spec: podSpec},
+		},
+		{
+			name:      "pod delete",
+			resource:  podsResource,
+			operation: v1.Delete,
+			oldObject: corev1.Pod{Spec: podSpec},
+		},
+		{
+			name:      "job update does not patch the immutable template",
+			resource:  jobsResource,
+			operation: v1.Update,
+			oldObject: batchv1.Job{Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{Spec: podSpec}}},
+			object:    batchv1.Job{ObjectMeta: labeled, Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{Spec: podSpec}}},
+		},
+		{
+			name:      "deployment update without template changes",
+			resource:  deploymentsResource,
+			operation: v1.Update,
+			oldObject: appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: podSpec}}},
+			object:    appsv1.Deployment{ObjectMeta: labeled, Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: podSpec}}},
+		},
+		{
+			name:      "deployment update with template changes",
+			resource:  deploymentsResource,
+			operation: v1.Update,
+			oldObject: appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: podSpec}}},
+			object:    appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: newPodSpec}}},
+			patched:   true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := &v1.AdmissionRequest{
+				Resource:  tc.resource,
+				Namespace: "default",
+				Operation: tc.operation,
+			}
+			if tc.object != nil {
+				request.Object = runtime.RawExtension{Raw: mustMarshal(tc.object)}
+			}
+			if tc.oldObject != nil {
+				request.OldObject = runtime.RawExtension{Raw: mustMarshal(tc.oldObject)}
+			}
+			ar := v1.AdmissionReview{Request: request}
+			response := mutateSecurityContext(ar, webhook.Codecs())
+			require.True(t, response.Allowed)
+			require.Equal(t, tc.patched, response.Patch != nil)
+			// Validation must not reject updates of pods that predate the hook
+			if tc.resource == podsResource && tc.operation != v1.Create {
+				response = validateSecurityContext(ar, webhook.Codecs())
+				require.True(t, response.Allowed)
+			}
+		})
+	}
+}
@@ -17,30 +17,40 @@ limitations under the License.
 package cmd
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"maps"
+	"reflect"
+	"slices"
 
 	"github.com/warpcomdev/think8shook/internal/webhook"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
 	v1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/klog/v2"
 )
 
+// Fallback identity injected when the policy config does not override it
 const (
 	InjectedUID = 1000
 	InjectedGID = 1000
 )
 
+// ephemeralContainersSubresource is used by kubectl debug to add
+// ephemeral containers to a running pod
+const ephemeralContainersSubresource = "ephemeralcontainers"
+
 type jsonPatch struct {
 	Op    string          `json:"op"`
 	Path  string          `json:"path"`
-	Value json.RawMessage `json:"value"`
+	Value json.RawMessage `json:"value,omitempty"`
 }
 
 type patchSet struct {
 	patches []jsonPatch
+	records []mutationRecord
 }
 
 func (ps *patchSet) append(op, path string, value interface{}) error {
@@ -56,6 +66,133 @@ func (ps *patchSet) append(op, path string, value interface{}) error {
 	return nil
 }
 
+// appendDiff appends the minimal add / replace / remove operations that
+// turn before into after at path. Objects are compared field by field,
+// so that fields set by other webhooks are kept. Arrays that change
+// length, and any other value, are replaced as a whole.
+func (ps *patchSet) appendDiff(path string, before, after interface{}) error {
+	beforeValue, err := toJSONValue(before)
+	if err != nil {
+		return err
+	}
+	afterValue, err := toJSONValue(after)
+	if err != nil {
+		return err
+	}
+	return ps.diffValues(path, beforeValue, afterValue)
+}
+
+func (ps *patchSet) diffValues(path string, before, after interface{}) error {
+	// Arrays of the same length are compared item by item, so that
+	// editing a container does not replace the whole list
+	beforeArray, isArray := before.([]interface{})
+	afterArray, bothArrays := after.([]interface{})
+	if isArray && bothArrays && len(beforeArray) == len(afterArray) {
+		for idx := range afterArray {
+			if err := ps.diffValues(fmt.Sprintf("%s/%d", path, idx), beforeArray[idx], afterArray[idx]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	beforeObject, isObject := before.(map[string]interface{})
+	afterObject, bothObjects := after.(map[string]interface{})
+	if !isObject || !bothObjects {
+		switch {
+		case reflect.DeepEqual(before, after):
+			return nil
+		case after == nil:
+			ps.patches = append(ps.patches, jsonPatch{Op: "remove", Path: path})
+			return nil
+		case before == nil:
+			return ps.append("add", path, after)
+		default:
+			return ps.append("replace", path, after)
+		}
+	}
+	keys := slices.Sorted(maps.Keys(beforeObject))
+	for key := range afterObject {
+		if _, ok := beforeObject[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		fieldPath := path + "/" + escapePathSegment(key)
+		beforeField, inBefore := beforeObject[key]
+		afterField, inAfter := afterObject[key]
+		switch {
+		case !inAfter:
+			ps.patches = append(ps.patches, jsonPatch{Op: "remove", Path: fieldPath})
+		case !inBefore:
+			if err := ps.append("add", fieldPath, afterField); err != nil {
+				return err
+			}
+		default:
+			if err := ps.diffValues(fieldPath, beforeField, afterField); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// toJSONValue converts a value to its generic JSON representation,
+// keeping numbers as json.Number to avoid losing precision
+func toJSONValue(value interface{}) (interface{}, error) {
+	marshal, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(marshal))
+	decoder.UseNumber()
+	var result interface{}
+	if err := decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// withPrefix returns a copy of the patchSet with all paths relative to prefix
+func (ps patchSet) withPrefix(prefix string) patchSet {
+	if prefix == "" {
+		return ps
+	}
+	prefixed := patchSet{
+		patches: make([]jsonPatch, 0, len(ps.patches)),
+		records: make([]mutationRecord, 0, len(ps.records)),
+	}
+	for _, patch := range ps.patches {
+		patch.Path = prefix + patch.Path
+		prefixed.patches = append(prefixed.patches, patch)
+	}
+	for _, record := range ps.records {
+		record.path = prefix + record.path
+		prefixed.records = append(prefixed.records, record)
+	}
+	return prefixed
+}
+
+// filter returns a copy of the patchSet with only the patches and records
+// whose path satisfies the keep function
+func (ps patchSet) filter(keep func(path string) bool) patchSet {
+	filtered := patchSet{
+		patches: make([]jsonPatch, 0, len(ps.patches)),
+		records: make([]mutationRecord, 0, len(ps.records)),
+	}
+	for _, patch := range ps.patches {
+		if keep(patch.Path) {
+			filtered.patches = append(filtered.patches, patch)
+		}
+	}
+	for _, record := range ps.records {
+		if keep(record.path) {
+			filtered.records = append(filtered.records, record)
+		}
+	}
+	return filtered
+}
+
 func (ps patchSet) Json() (json.RawMessage, error) {
 	marshal, err := json.Marshal(ps.patches)
 	if err != nil {
@@ -70,59 +207,129 @@ func (ps patchSet) String() string {
 }
 
 // podFilterFuncreturns true if pod shpuld be mutated
-type podFilterFunc func(pod *corev1.Pod) bool
+type podFilterFunc func(req *v1.AdmissionRequest, pod *corev1.Pod) bool
 
-// podSpecMutateFunc mutates the pod spec-level fields of the pod, excluding containers
+// podSpecMutateFunc mutates the pod spec-level fields of the pod, excluding
+// containers. It edits a copy of the pod in place, and only uses the
+// patchSet to record audit entries; the patch is computed by podEditor.
 type podSpecMutateFunc func(pod *corev1.Pod, ps *patchSet) error
 
-// containerMutateFunc mutates the container-level fields of the pod
+// containerMutateFunc mutates the container-level fields of the pod. The
+// container is edited in place, path is the JSON pointer of the container.
 type containerMutateFunc func(path string, container *corev1.Container, ps *patchSet) error
 
 // podMutatorFunc combines pod-spec and container mutations
-type podMutatorFunc func(pod *corev1.Pod, ps *patchSet) error
+type podMutatorFunc func(req *v1.AdmissionRequest, pod *corev1.Pod, ps *patchSet) error
+
+// podEditor applies typed edits to a copy of the pod, and appends to the
+// patchSet the JSON patch between the pod before and after each edit.
+// Mutators never need to build patch paths nor choose between add and
+// replace, and the operations are sorted in the order of the edits.
+type podEditor struct {
+	current *corev1.Pod
+	ps      *patchSet
+}
+
+func newPodEditor(pod *corev1.Pod, ps *patchSet) *podEditor {
+	return &podEditor{current: pod.DeepCopy(), ps: ps}
+}
+
+// edit runs the edit function over a copy of the current pod
+func (e *podEditor) edit(f func(pod *corev1.Pod) error) error {
+	next := e.current.DeepCopy()
+	if err := f(next); err != nil {
+		return err
+	}
+	if err := e.ps.appendDiff("", e.current, next); err != nil {
+		return err
+	}
+	e.current = next
+	return nil
+}
 
 func podMutator(podM podSpecMutateFunc, containerM containerMutateFunc) podMutatorFunc {
-	return func(pod *corev1.Pod, ps *patchSet) error {
+	return func(req *v1.AdmissionRequest, pod *corev1.Pod, ps *patchSet) error {
+		editor := newPodEditor(pod, ps)
 		// First: patch pod level securityPolicy
-		if err := podM(pod, ps); err != nil {
-			return nil
+		if err := editor.edit(func(pod *corev1.Pod) error { return podM(pod, ps) }); err != nil {
+			return err
 		}
 		// Next: patch containers
-		mutateContainers := func(path string, containers []corev1.Container) error {
-			if len(containers) > 0 {
-				for idx, ctx := range containers {
-					newPath := fmt.Sprintf("%s/%d", path, idx)
-					if err := containerM(newPath, &ctx, ps); err != nil {
-						return err
-					}
+		mutateContainers := func(path string, containers func(pod *corev1.Pod) []corev1.Container) error {
+			for idx := range containers(editor.current) {
+				newPath := fmt.Sprintf("%s/%d", path, idx)
+				err := editor.edit(func(pod *corev1.Pod) error {
+					return containerM(newPath, &containers(pod)[idx], ps)
+				})
+				if err != nil {
+					return err
 				}
 			}
 			return nil
 		}
-		if err := mutateContainers("/spec/initContainers", pod.Spec.InitContainers); err != nil {
+		if err := mutateContainers("/spec/initContainers", func(pod *corev1.Pod) []corev1.Container { return pod.Spec.InitContainers }); err != nil {
 			return err
 		}
-		if err := mutateContainers("/spec/containers", pod.Spec.Containers); err != nil {
+		if err := mutateContainers("/spec/containers", func(pod *corev1.Pod) []corev1.Container { return pod.Spec.Containers }); err != nil {
 			return err
 		}
+		// Ephemeral containers share the container fields we mutate
+		for idx := range editor.current.Spec.EphemeralContainers {
+			newPath := fmt.Sprintf("/spec/ephemeralContainers/%d", idx)
+			err := editor.edit(func(pod *corev1.Pod) error {
+				ec := &pod.Spec.EphemeralContainers[idx]
+				ctx := corev1.Container(ec.EphemeralContainerCommon)
+				if err := containerM(newPath, &ctx, ps); err != nil {
+					return err
+				}
+				ec.EphemeralContainerCommon = corev1.EphemeralContainerCommon(ctx)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
 		return nil
 	}
 }
 
-// podAdmission analizes admission request and mutates it
+// podAdmission analizes admission request and mutates it. The request object
+// may be a pod or any of the workloads with a pod template in podDecoders.
 func podAdmission(ar v1.AdmissionReview, codecs *serializer.CodecFactory, filter podFilterFunc, mutator podMutatorFunc) *v1.AdmissionResponse {
 	klog.V(2).Info("mutating pods")
-	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
-	if ar.Request.Resource != podResource {
-		klog.Errorf("expect resource to be %s", podResource)
-		return nil
+	outcome := outcomeError
+	defer func() { countRequest(mutatingWebhook, ar.Request, outcome) }()
+	if !isMutableOperation(ar.Request) {
+		outcome = outcomeUnchanged
+		return &v1.AdmissionResponse{Allowed: true}
 	}
-
-	raw := ar.Request.Object.Raw
-	pod := corev1.Pod{}
 	deserializer := codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(raw, nil, &pod); err != nil {
+	pod, prefix, err := decodePod(ar.Request.Resource, ar.Request.Object.Raw, deserializer)
+	if err != nil {
 		klog.Error(err)
+		decodeErrors.Inc()
+		return webhook.V1AdmissionError(err)
+	}
+	// on update, only the fields that can legally change may be patched
+	var mutable func(path string) bool
+	if ar.Request.Operation == v1.Update {
+		oldPod, _, err := decodePod(ar.Request.Resource, ar.Request.OldObject.Raw, deserializer)
+		if err != nil {
+			klog.Error(err)
+			decodeErrors.Inc()
+			return webhook.V1AdmissionError(err)
+		}
+		mutable = mutableOnUpdate(ar.Request, oldPod, pod)
+	}
+	// pods being created may not have the namespace set yet
+	if pod.Namespace == "" {
+		pod.Namespace = ar.Request.Namespace
+	}
+	// keep a copy of the pod before mutation, to check the result
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		klog.Error(err)
+		marshalErrors.Inc()
 		return webhook.V1AdmissionError(err)
 	}
 	reviewResponse := v1.AdmissionResponse{}
@@ -131,159 +338,83 @@ func podAdmission(ar v1.AdmissionReview, codecs *serializer.CodecFactory, filter
 	ps := &patchSet{
 		patches: make([]jsonPatch, 0, 16),
 	}
-	if filter(&pod) {
-		if err := mutator(&pod, ps); err != nil {
+	if !filter(ar.Request, pod) {
+		outcome = outcomeSkipped
+		podRecorder.record(ar.Request, raw, false, ps)
+		return &reviewResponse
+	}
+	// the pod is rejected rather than admitted without hardening
+	if err := mutator(ar.Request, pod, ps); err != nil {
+		klog.Error(err)
+		return webhook.V1AdmissionError(fmt.Errorf("failed to mutate pod: %w", err))
+	}
+	if mutable != nil {
+		filtered := ps.filter(mutable)
+		ps = &filtered
+	}
+	// fixtures do not include the annotation, see TestSecurityPatches
+	podRecorder.record(ar.Request, raw, true, ps)
+	if policy.AnnotateMutated {
+		if err := ps.annotateMutated(raw); err != nil {
+			klog.Error(err)
+		}
+	}
+	patchBytes, err := ps.withPrefix(prefix).Json()
+	if err != nil {
+		klog.Error(err)
+		marshalErrors.Inc()
+		return &reviewResponse
+	}
+	outcome = outcomeUnchanged
+	if len(ps.patches) > 0 {
+		reviewResponse.Patch = patchBytes
+		pt := v1.PatchTypeJSONPatch
+		reviewResponse.PatchType = &pt
+		outcome = outcomeMutated
+		countPatches(ps)
+	}
+	reviewResponse.AuditAnnotations = ps.auditAnnotations()
+	reviewResponse.Warnings = ps.warnings()
+	if policy.Restricted {
+		if mutated, err := applyPatch(raw, ps); err != nil {
 			klog.Error(err)
 		} else {
-			patchBytes, err := ps.Json()
-			if err != nil {
-				klog.Error(err)
-			} else {
-				if len(patchBytes) > 0 {
-					reviewResponse.Patch = patchBytes
-					pt := v1.PatchTypeJSONPatch
-					reviewResponse.PatchType = &pt
-				}
-			}
+			reviewResponse.Warnings = append(reviewResponse.Warnings, restrictedWarnings(mutated)...)
 		}
 	}
 	return &reviewResponse
 }
 
-// shouldMutateSecurityContext returns true if the pod must be mutated
-func shouldMutateSecurityContext(pod *corev1.Pod) bool {
-	labels := pod.GetObjectMeta().GetLabels()
-	// skip pods labeled with priviledged enforcement
-	if priv, ok := labels["pod-security.kubernetes.io/enforce"]; ok && priv == "privileged" {
-		return false
+// applyPatch applies the patchSet to the raw pod and returns the result
+func applyPatch(raw []byte, ps *patchSet) (*corev1.Pod, error) {
+	patchBytes, err := ps.Json()
+	if err != nil {
+		return nil, err
 	}
-	return true
-}
-
-// mutatePodSecurityContext mutates the pod with the required securityContext configs
-func mutatePodSecurityContext(pod *corev1.Pod, ps *patchSet) error {
-	sc := pod.Spec.SecurityContext
-	op := "replace"
-	modified := false
-	if sc == nil {
-		sc = &corev1.PodSecurityContext{}
-		op = "add"
-	}
-	switch {
-	case sc.RunAsUser == nil && sc.RunAsGroup == nil && sc.FSGroup == nil:
-		// Nothing defined, set all to defaults
-		var (
-			uid     int64 = InjectedUID
-			gid     int64 = InjectedGID
-			fsGroup int64 = InjectedGID
-		)
-		sc.RunAsUser = &uid
-		sc.RunAsGroup = &gid
-		sc.FSGroup = &fsGroup
-		modified = true
-		break
-	case sc.RunAsUser == nil && sc.RunAsGroup == nil && sc.FSGroup != nil:
-		// Only fsGroup defined: propagate to the other values
-		var (
-			uid int64 = *sc.FSGroup
-			gid int64 = *sc.FSGroup
-		)
-		sc.RunAsUser = &uid
-		sc.RunAsGroup = &gid
-		modified = true
-		break
-	case sc.RunAsUser == nil && sc.RunAsGroup != nil && sc.FSGroup == nil:
-		// Only RunAsGroup defined: propagate to the other values
-		var (
-			uid     int64 = *sc.RunAsGroup
-			fsGroup int64 = *sc.RunAsGroup
-		)
-		sc.RunAsUser = &uid
-		sc.FSGroup = &fsGroup
-		modified = true
-		break
-	case sc.RunAsUser == nil && sc.RunAsGroup != nil && sc.FSGroup != nil:
-		// Both RunAsGroup and FSGroup defined: copy group to RunAsUser
-		var (
-			uid int64 = *sc.RunAsGroup
-		)
-		sc.RunAsUser = &uid
-		modified = true
-		break
-	case sc.RunAsUser != nil && sc.RunAsGroup == nil && sc.FSGroup == nil:
-		// Only RunAsUser defined: propagate
-		var (
-			gid     int64 = *sc.RunAsUser
-			fsGroup int64 = *sc.RunAsUser
-		)
-		sc.RunAsGroup = &gid
-		sc.FSGroup = &fsGroup
-		modified = true
-		break
-	case sc.RunAsUser != nil && sc.RunAsGroup == nil && sc.FSGroup != nil:
-		// Only RunAsGroup undefined: fill with fsGroup
-		var (
-			gid int64 = *sc.FSGroup
-		)
-		sc.RunAsGroup = &gid
-		modified = true
-		break
-	case sc.RunAsUser != nil && sc.RunAsGroup != nil && sc.FSGroup == nil:
-		// Only fsGroup undefied: fill with RunAsGroup
-		var (
-			fsGroup int64 = *sc.RunAsGroup
-		)
-		sc.FSGroup = &fsGroup
-		modified = true
-		break
-	case sc.RunAsUser != nil && sc.RunAsGroup != nil && sc.FSGroup != nil:
-		break
-	}
-	if sc.RunAsNonRoot == nil {
-		var nonRoot = (*sc.RunAsUser != 0)
-		sc.RunAsNonRoot = &nonRoot
-		modified = true
-	}
-	if sc.SeccompProfile == nil {
-		sc.SeccompProfile = &corev1.SeccompProfile{
-			Type: corev1.SeccompProfileTypeRuntimeDefault,
-		}
-		modified = true
+	patch, err := jsonpatch.DecodePatch(patchBytes)
+	if err != nil {
+		return nil, err
 	}
-	if !modified {
-		return nil
+	patched, err := patch.Apply(raw)
+	if err != nil {
+		return nil, err
 	}
-	return ps.append(op, "/spec/securityContext", sc)
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(patched, pod); err != nil {
+		return nil, err
+	}
+	return pod, nil
 }
 
-func mutateContainerSecurityContext(path string, container *corev1.Container, ps *patchSet) error {
-	sc := container.SecurityContext
-	op := "replace"
-	modified := false
-	if sc == nil {
-		sc = &corev1.SecurityContext{}
-		op = "add"
-	}
-	if sc.AllowPrivilegeEscalation != nil && *sc.AllowPrivilegeEscalation == true {
-		modified = true
-		sc.AllowPrivilegeEscalation = nil
-	}
-	if sc.Privileged != nil && *sc.Privileged == true {
-		modified = true
-		sc.Privileged = nil
-	}
-	if sc.Capabilities == nil {
-		modified = true
-		sc.Capabilities = &corev1.Capabilities{
-			Drop: []corev1.Capability{"ALL"},
-		}
-	}
-	if !modified {
-		return nil
+// shouldMutateSecurityContext returns true if the pod is not exempt
+func shouldMutateSecurityContext(req *v1.AdmissionRequest, pod *corev1.Pod) bool {
+	if rule := policy.Exemptions.exemptionRule(req, pod); rule != "" {
+		klog.Infof("skipping %s %s/%s: exempted by %s", req.Resource.Resource, req.Namespace, req.Name, rule)
+		return false
 	}
-	return ps.append(op, fmt.Sprintf("%s/securityContext", path), sc)
+	return true
 }
 
 func mutateSecurityContext(ar v1.AdmissionReview, codecs *serializer.CodecFactory) *v1.AdmissionResponse {
-	return podAdmission(ar, codecs, shouldMutateSecurityContext, podMutator(mutatePodSecurityContext, mutateContainerSecurityContext))
+	return podAdmission(ar, codecs, shouldMutateSecurityContext, mutateRules)
 }
@@ -26,8 +26,14 @@ import (
 
 	"github.com/stretchr/testify/require"
 	"github.com/warpcomdev/think8shook/internal/webhook"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	v1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/yaml"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 )
 
@@ -39,12 +45,6 @@ func mustMarshal(v interface{}) json.RawMessage {
 	return json.RawMessage(marshal)
 }
 
-type podTestCase struct {
-	Initial      map[string]json.RawMessage `json:"initial"`
-	ShouldMutate bool                       `json:"shouldMutate"`
-	Expected     []jsonPatch                `json:"expected"`
-}
-
 func TestSecurityPatches(t *testing.T) {
 	var fset flag.FlagSet
 	klog.InitFlags(&fset)
@@ -53,7 +53,7 @@ func TestSecurityPatches(t *testing.T) {
 		"--logtostderr", "true",
 	})
 	defer klog.Flush()
-	mutator := podMutator(mutatePodSecurityContext, mutateContainerSecurityContext)
+	mutator := mutateRules
 	err := filepath.WalkDir("pod_tests", func(path string, info fs.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -62,34 +62,7 @@ func TestSecurityPatches(t *testing.T) {
 			return nil
 		}
 		t.Run(path, func(t *testing.T) {
-			// The yaml file provides pod and expected filter and mutation result.
-			yamlFile, err := os.ReadFile(path)
-			if err != nil {
-				t.Fatal(err)
-			}
-			var testCase podTestCase
-			if err := yaml.Unmarshal(yamlFile, &testCase); err != nil {
-				t.Fatal(err)
-			}
-			// Pod must be properly deserialized
-			deserializer := webhook.Codecs().UniversalDeserializer()
-			var pod corev1.Pod
-			if _, _, err := deserializer.Decode(testCase.Initial["pod"], nil, &pod); err != nil {
-				t.Fatal(err)
-			}
-			// Check if mutation filter matches
-			mutated := shouldMutateSecurityContext(&pod)
-			if mutated != testCase.ShouldMutate {
-				t.Fatalf("expected mutated = %v, got %v", testCase.ShouldMutate, mutated)
-			}
-			// Test if mutations match
-			ps := &patchSet{
-				patches: make([]jsonPatch, 0, 16),
-			}
-			if err := mutator(&pod, ps); err != nil {
-				t.Fatal(err)
-			}
-			mustEqual(t, ps, testCase.Expected)
+			checkPodFixture(t, mutator, path)
 		})
 		return nil
 	})
@@ -98,6 +71,238 @@ func TestSecurityPatches(t *testing.T) {
 	}
 }
 
+// checkPodFixture runs the mutator on the fixture pod and compares
+// the results with the ones expected by the fixture
+func checkPodFixture(t *testing.T, mutator podMutatorFunc, path string) {
+	// The yaml file provides pod and expected filter and mutation result.
+	yamlFile, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testCase podFixture
+	if err := yaml.Unmarshal(yamlFile, &testCase); err != nil {
+		t.Fatal(err)
+	}
+	// Policy overrides are applied on top of the defaults
+	policy = defaultPolicyConfig()
+	defer func() { policy = defaultPolicyConfig() }()
+	if len(testCase.Policy) > 0 {
+		if err := json.Unmarshal(testCase.Policy, &policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Namespace, if any, is made available to the mutators
+	deserializer := webhook.Codecs().UniversalDeserializer()
+	namespaceLister, namespaceExemptions = nil, false
+	defer func() { namespaceLister, namespaceExemptions = nil, false }()
+	if raw, ok := testCase.Initial["namespace"]; ok {
+		var ns corev1.Namespace
+		if _, _, err := deserializer.Decode(raw, nil, &ns); err != nil {
+			t.Fatal(err)
+		}
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		if err := indexer.Add(&ns); err != nil {
+			t.Fatal(err)
+		}
+		namespaceLister = corelisters.NewNamespaceLister(indexer)
+		namespaceExemptions = true
+	}
+	// Pod must be properly deserialized
+	var pod corev1.Pod
+	if _, _, err := deserializer.Decode(testCase.Initial["pod"], nil, &pod); err != nil {
+		t.Fatal(err)
+	}
+	// Request, if any, provides the user info
+	request := &v1.AdmissionRequest{
+		Resource:  podsResource,
+		Namespace: pod.Namespace,
+		Name:      pod.Name,
+		Operation: v1.Create,
+	}
+	if raw, ok := testCase.Initial["request"]; ok {
+		if err := json.Unmarshal(raw, request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Check if mutation filter matches
+	mutated := shouldMutateSecurityContext(request, &pod)
+	if mutated != testCase.ShouldMutate {
+		t.Fatalf("expected mutated = %v, got %v", testCase.ShouldMutate, mutated)
+	}
+	// Test if mutations match
+	ps := &patchSet{
+		patches: make([]jsonPatch, 0, 16),
+	}
+	if mutated {
+		if err := mutator(request, &pod, ps); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustEqual(t, ps, testCase.Expected)
+	// Check the violations remaining after the mutation
+	mutatedPod := mustApply(t, testCase.Initial["pod"], ps)
+	require.Equal(t, testCase.Violations, validatePodSecurityContext(&mutatedPod))
+	// Check the warnings returned to the user
+	warnings := ps.warnings()
+	if policy.Restricted {
+		warnings = append(warnings, restrictedWarnings(&mutatedPod)...)
+	}
+	require.Equal(t, testCase.Warnings, warnings)
+	if testCase.Audit != nil {
+		require.Equal(t, testCase.Audit, ps.auditAnnotations())
+	}
+}
+
+func TestEphemeralContainersSubresource(t *testing.T) {
+	privileged := true
+	oldPod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "test", Image: "busybox/latest"}},
+			EphemeralContainers: []corev1.EphemeralContainer{{
+				EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger-1", Image: "busybox/latest"},
+			}},
+		},
+	}
+	pod := *oldPod.DeepCopy()
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, corev1.EphemeralContainer{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+			Name:            "debugger-2",
+			Image:           "busybox/latest",
+			SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+		},
+	})
+	ar := v1.AdmissionReview{
+		Request: &v1.AdmissionRequest{
+			Resource:    metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			SubResource: ephemeralContainersSubresource,
+			Namespace:   "default",
+			Operation:   v1.Update,
+			Object:      runtime.RawExtension{Raw: mustMarshal(pod)},
+			OldObject:   runtime.RawExtension{Raw: mustMarshal(oldPod)},
+		},
+	}
+	response := mutateSecurityContext(ar, webhook.Codecs())
+	require.True(t, response.Allowed)
+	// Only the new ephemeral container may be patched
+	var patches []jsonPatch
+	require.NoError(t, json.Unmarshal(response.Patch, &patches))
+	require.Len(t, patches, 2)
+	require.Equal(t, "add", patches[0].Op)
+	require.Equal(t, "/spec/ephemeralContainers/1/securityContext/capabilities", patches[0].Path)
+	require.JSONEq(t, `{"drop":["ALL"]}`, string(patches[0].Value))
+	require.Equal(t, jsonPatch{Op: "remove", Path: "/spec/ephemeralContainers/1/securityContext/privileged"}, patches[1])
+}
+
+func TestPodEditor(t *testing.T) {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "app", Image: "busybox/latest", ImagePullPolicy: corev1.PullAlways},
+			{Name: "sidecar", Image: "envoy/latest"},
+		}},
+	}
+	original := *pod.DeepCopy()
+	ps := &patchSet{}
+	editor := newPodEditor(&pod, ps)
+	// Edits are plain functions over the typed pod
+	require.NoError(t, editor.edit(func(pod *corev1.Pod) error {
+		pod.Labels = map[string]string{"app.kubernetes.io/name": "test"}
+		return nil
+	}))
+	require.NoError(t, editor.edit(func(pod *corev1.Pod) error {
+		pod.Spec.Containers[1].Env = append(pod.Spec.Containers[1].Env, corev1.EnvVar{Name: "LEVEL", Value: "debug"})
+		pod.Spec.Containers[0].ImagePullPolicy = ""
+		return nil
+	}))
+	require.Equal(t, original, pod, "the original pod must not be modified")
+	require.Equal(t, []jsonPatch{
+		{Op: "add", Path: "/metadata/labels", Value: json.RawMessage(`{"app.kubernetes.io/name":"test"}`)},
+		{Op: "remove", Path: "/spec/containers/0/imagePullPolicy"},
+		{Op: "add", Path: "/spec/containers/1/env", Value: json.RawMessage(`[{"name":"LEVEL","value":"debug"}]`)},
+	}, ps.patches)
+
+	// Lists that change length are replaced as a whole
+	require.NoError(t, editor.edit(func(pod *corev1.Pod) error {
+		pod.Spec.Containers = pod.Spec.Containers[:1]
+		return nil
+	}))
+	require.Equal(t, "replace", ps.patches[3].Op)
+	require.Equal(t, "/spec/containers", ps.patches[3].Path)
+	require.Equal(t, *editor.current, mustApply(t, mustMarshal(original), ps))
+}
+
+func TestFieldLevelPatches(t *testing.T) {
+	policy = defaultPolicyConfig()
+	uid, privileged, escalation := int64(2000), true, true
+	// Fields set by other webhooks earlier in the chain must be kept
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			SecurityContext: &corev1.PodSecurityContext{
+				RunAsUser:          &uid,
+				SupplementalGroups: []int64{3000},
+				SELinuxOptions:     &corev1.SELinuxOptions{Level: "s0:c123,c456"},
+			},
+			Containers: []corev1.Container{{
+				Name:  "test",
+				Image: "busybox/latest",
+				SecurityContext: &corev1.SecurityContext{
+					Privileged:               &privileged,
+					AllowPrivilegeEscalation: &escalation,
+					ReadOnlyRootFilesystem:   &privileged,
+				},
+			}},
+		},
+	}
+	expected := *pod.DeepCopy()
+	nonRoot := true
+	expected.Spec.SecurityContext.RunAsGroup = &uid
+	expected.Spec.SecurityContext.FSGroup = &uid
+	expected.Spec.SecurityContext.RunAsNonRoot = &nonRoot
+	expected.Spec.SecurityContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+	expected.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{
+		ReadOnlyRootFilesystem: &privileged,
+		Capabilities:           &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+	}
+
+	raw := mustMarshal(pod)
+	ps := &patchSet{}
+	require.NoError(t, mutateRules(nil, &pod, ps))
+	for _, patch := range ps.patches {
+		require.NotEqual(t, "/spec/securityContext", patch.Path)
+		require.NotEqual(t, "/spec/containers/0/securityContext", patch.Path)
+	}
+	require.Equal(t, expected, mustApply(t, raw, ps))
+}
+
+func TestPatchPathEscaping(t *testing.T) {
+	before := map[string]string{"keep": "x", "app.kubernetes.io/name": "old", "drop~me": "y"}
+	after := map[string]string{"keep": "x", "app.kubernetes.io/name": "new", "think8shook.io/mutated": "z"}
+	ps := &patchSet{}
+	require.NoError(t, ps.appendDiff("/metadata/annotations", before, after))
+	require.Equal(t, []jsonPatch{
+		{Op: "replace", Path: "/metadata/annotations/app.kubernetes.io~1name", Value: json.RawMessage(`"new"`)},
+		{Op: "remove", Path: "/metadata/annotations/drop~0me"},
+		{Op: "add", Path: "/metadata/annotations/think8shook.io~1mutated", Value: json.RawMessage(`"z"`)},
+	}, ps.patches)
+
+	patchBytes, err := ps.Json()
+	require.NoError(t, err)
+	patch, err := jsonpatch.DecodePatch(patchBytes)
+	require.NoError(t, err)
+	patched, err := patch.Apply(mustMarshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": before}}))
+	require.NoError(t, err)
+	require.JSONEq(t, string(mustMarshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": after}})), string(patched))
+}
+
+func mustApply(t *testing.T, raw json.RawMessage, ps *patchSet) corev1.Pod {
+	pod, err := applyPatch(raw, ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *pod
+}
+
 func mustEqual(t *testing.T, actual *patchSet, expected []jsonPatch) {
 	if len(actual.patches) != len(expected) {
 		t.Errorf("patch sets length do not match, got %s", actual)
@@ -113,6 +318,9 @@ func mustEqual(t *testing.T, actual *patchSet, expected []jsonPatch) {
 			t.Errorf("Paths differ at position %d: expected %v, got %v", i, e.Path, a.Path)
 			return
 		}
-		require.JSONEq(t, string(e.Value), string(a.Value))
+		// remove operations have no value
+		if len(e.Value) > 0 || len(a.Value) > 0 {
+			require.JSONEq(t, string(e.Value), string(a.Value))
+		}
 	}
 }
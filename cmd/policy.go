@@ -0,0 +1,271 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// policyConfig holds the defaults injected by the pod mutators
+type policyConfig struct {
+	// RunAsUser injected when the pod does not define any identity
+	RunAsUser int64 `json:"runAsUser"`
+	// RunAsGroup injected when the pod does not define any identity
+	RunAsGroup int64 `json:"runAsGroup"`
+	// FSGroup injected when the pod does not define any identity
+	FSGroup int64 `json:"fsGroup"`
+	// SeccompProfile injected when the pod does not define one
+	SeccompProfile corev1.SeccompProfile `json:"seccompProfile"`
+	// AllowedCapabilities containers may add without being rejected
+	AllowedCapabilities []corev1.Capability `json:"allowedCapabilities"`
+	// Restricted mutates pods until they pass the Pod Security Standards
+	// restricted level, and warns about the checks still failing
+	Restricted bool `json:"restricted"`
+	// AnnotateMutated stamps the rules applied on the mutated pods
+	AnnotateMutated bool `json:"annotateMutated"`
+	// Exemptions skip mutation and validation of the matching pods
+	Exemptions exemptionConfig `json:"exemptions"`
+	// Rules are the mutation rules to apply, in order. All the declared
+	// rules in their declared order if empty.
+	Rules []string `json:"rules,omitempty"`
+	// DisabledRules are removed from Rules
+	DisabledRules []string `json:"disabledRules,omitempty"`
+	// Mutations declare the mutation rules, replacing the ones of the
+	// embedded default policy. The default ones if empty.
+	Mutations []mutationSpec `json:"mutations,omitempty"`
+	// compiled are the rules declared by Mutations, set by loadPolicyConfig
+	compiled ruleSet
+}
+
+// policy is the configuration used by the mutators. It is replaced
+// at startup with the result of loadPolicyConfig.
+var policy = defaultPolicyConfig()
+
+// defaultPolicyConfig returns the policy used when nothing is configured
+func defaultPolicyConfig() policyConfig {
+	return policyConfig{
+		RunAsUser:  InjectedUID,
+		RunAsGroup: InjectedGID,
+		FSGroup:    InjectedGID,
+		SeccompProfile: corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+		AllowedCapabilities: []corev1.Capability{"NET_BIND_SERVICE"},
+		Exemptions:          defaultExemptionConfig(),
+	}
+}
+
+// addPolicyFlags registers the policy flags in the given flagset.
+// Flag values override the ones read from the policy config file.
+func addPolicyFlags(fs *pflag.FlagSet, cfg *policyConfig, path *string) {
+	defaults := defaultPolicyConfig()
+	fs.StringVar(path, "policy-config", "",
+		"YAML file with the policy configuration (runAsUser, runAsGroup, fsGroup, seccompProfile, allowedCapabilities, restricted, annotateMutated, exemptions, rules, disabledRules), or a versioned "+PolicyGroupVersion.String()+" "+HardeningPolicyKind+" that may also declare the mutations.")
+	fs.Int64Var(&cfg.RunAsUser, "run-as-user", defaults.RunAsUser,
+		"Default runAsUser injected in pods without identity. Overrides the policy config file.")
+	fs.Int64Var(&cfg.RunAsGroup, "run-as-group", defaults.RunAsGroup,
+		"Default runAsGroup injected in pods without identity. Overrides the policy config file.")
+	fs.Int64Var(&cfg.FSGroup, "fs-group", defaults.FSGroup,
+		"Default fsGroup injected in pods without identity. Overrides the policy config file.")
+	fs.StringVar((*string)(&cfg.SeccompProfile.Type), "seccomp-profile", string(defaults.SeccompProfile.Type),
+		"Default seccomp profile type (RuntimeDefault, Localhost, Unconfined). Overrides the policy config file.")
+	fs.Var(newOptionalString(&cfg.SeccompProfile.LocalhostProfile), "seccomp-localhost-profile",
+		"Localhost profile path, required when --seccomp-profile=Localhost.")
+	cfg.AllowedCapabilities = defaults.AllowedCapabilities
+	fs.Var(newCapabilityList(&cfg.AllowedCapabilities), "allowed-capabilities",
+		"Comma separated list of capabilities containers are allowed to add. Overrides the policy config file.")
+	fs.BoolVar(&cfg.Restricted, "restricted", defaults.Restricted,
+		"Mutate pods to comply with the Pod Security Standards restricted level. Overrides the policy config file.")
+	fs.BoolVar(&cfg.AnnotateMutated, "annotate-mutated", defaults.AnnotateMutated,
+		"Stamp the "+MutatedAnnotation+" annotation listing the rules applied on mutated pods. Overrides the policy config file.")
+	fs.StringSliceVar(&cfg.Rules, "rules", nil,
+		"Comma separated list of mutation rules to apply, in order ("+strings.Join(defaultRules().names(), ", ")+"). All of them if empty. Overrides the policy config file.")
+	fs.StringSliceVar(&cfg.DisabledRules, "disable-rules", nil,
+		"Comma separated list of mutation rules not to apply. Overrides the policy config file.")
+}
+
+// loadPolicyConfig reads the policy config file, if any, and applies
+// the flags that have been explicitly set on top of it.
+func loadPolicyConfig(path string, fs *pflag.FlagSet, flags policyConfig) (policyConfig, error) {
+	cfg := defaultPolicyConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		if isVersionedPolicy(data) {
+			if cfg, err = decodeHardeningPolicy(data, cfg); err != nil {
+				return cfg, fmt.Errorf("failed to parse policy %s: %w", path, err)
+			}
+		} else if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("failed to parse policy config %s: %w", path, err)
+		}
+		if len(cfg.Mutations) > 0 {
+			if cfg.compiled, err = compileMutations(cfg.Mutations, policyBuiltins()); err != nil {
+				return cfg, fmt.Errorf("invalid mutations in policy %s: %w", path, err)
+			}
+		}
+	}
+	if fs.Changed("run-as-user") {
+		cfg.RunAsUser = flags.RunAsUser
+	}
+	if fs.Changed("run-as-group") {
+		cfg.RunAsGroup = flags.RunAsGroup
+	}
+	if fs.Changed("fs-group") {
+		cfg.FSGroup = flags.FSGroup
+	}
+	if fs.Changed("seccomp-profile") {
+		cfg.SeccompProfile.Type = flags.SeccompProfile.Type
+		cfg.SeccompProfile.LocalhostProfile = nil
+	}
+	if fs.Changed("seccomp-localhost-profile") {
+		cfg.SeccompProfile.LocalhostProfile = flags.SeccompProfile.LocalhostProfile
+	}
+	if fs.Changed("allowed-capabilities") {
+		cfg.AllowedCapabilities = flags.AllowedCapabilities
+	}
+	if fs.Changed("restricted") {
+		cfg.Restricted = flags.Restricted
+	}
+	if fs.Changed("annotate-mutated") {
+		cfg.AnnotateMutated = flags.AnnotateMutated
+	}
+	if fs.Changed("rules") {
+		cfg.Rules = flags.Rules
+	}
+	if fs.Changed("disable-rules") {
+		cfg.DisabledRules = flags.DisabledRules
+	}
+	return cfg, cfg.validate()
+}
+
+// validate checks the policy config is consistent
+func (cfg policyConfig) validate() error {
+	var errs []error
+	if cfg.RunAsUser < 0 {
+		errs = append(errs, fmt.Errorf("runAsUser must not be negative, got %d", cfg.RunAsUser))
+	}
+	if cfg.RunAsGroup < 0 {
+		errs = append(errs, fmt.Errorf("runAsGroup must not be negative, got %d", cfg.RunAsGroup))
+	}
+	if cfg.FSGroup < 0 {
+		errs = append(errs, fmt.Errorf("fsGroup must not be negative, got %d", cfg.FSGroup))
+	}
+	switch cfg.SeccompProfile.Type {
+	case corev1.SeccompProfileTypeRuntimeDefault, corev1.SeccompProfileTypeUnconfined:
+		if cfg.SeccompProfile.LocalhostProfile != nil {
+			errs = append(errs, fmt.Errorf("seccompProfile.localhostProfile is only valid for type %s", corev1.SeccompProfileTypeLocalhost))
+		}
+	case corev1.SeccompProfileTypeLocalhost:
+		if cfg.SeccompProfile.LocalhostProfile == nil || *cfg.SeccompProfile.LocalhostProfile == "" {
+			errs = append(errs, fmt.Errorf("seccompProfile.localhostProfile is required for type %s", corev1.SeccompProfileTypeLocalhost))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unsupported seccompProfile.type %q", cfg.SeccompProfile.Type))
+	}
+	if err := cfg.Exemptions.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	declared := cfg.declaredRules()
+	for idx, name := range cfg.Rules {
+		if _, ok := declared.find(name); !ok {
+			errs = append(errs, fmt.Errorf("unknown mutation rule %q, must be one of %v", name, declared.names()))
+		} else if slices.Contains(cfg.Rules[:idx], name) {
+			errs = append(errs, fmt.Errorf("mutation rule %q is listed more than once", name))
+		}
+	}
+	for _, name := range cfg.DisabledRules {
+		if _, ok := declared.find(name); !ok {
+			errs = append(errs, fmt.Errorf("unknown disabled mutation rule %q, must be one of %v", name, declared.names()))
+		}
+	}
+	if err := cfg.enabledRules().checkOrder(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// optionalString is a pflag.Value that stores a string pointer,
+// left nil until the flag is set
+type optionalString struct {
+	target **string
+}
+
+func newOptionalString(target **string) optionalString {
+	return optionalString{target: target}
+}
+
+func (o optionalString) String() string {
+	if o.target == nil || *o.target == nil {
+		return ""
+	}
+	return **o.target
+}
+
+func (o optionalString) Set(value string) error {
+	*o.target = &value
+	return nil
+}
+
+func (o optionalString) Type() string {
+	return "string"
+}
+
+// capabilityList is a pflag.Value that stores a comma separated
+// list of capabilities
+type capabilityList struct {
+	target *[]corev1.Capability
+}
+
+func newCapabilityList(target *[]corev1.Capability) capabilityList {
+	return capabilityList{target: target}
+}
+
+func (c capabilityList) String() string {
+	if c.target == nil {
+		return ""
+	}
+	names := make([]string, 0, len(*c.target))
+	for _, capability := range *c.target {
+		names = append(names, string(capability))
+	}
+	return strings.Join(names, ",")
+}
+
+func (c capabilityList) Set(value string) error {
+	capabilities := make([]corev1.Capability, 0, 4)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			capabilities = append(capabilities, corev1.Capability(name))
+		}
+	}
+	*c.target = capabilities
+	return nil
+}
+
+func (c capabilityList) Type() string {
+	return "strings"
+}
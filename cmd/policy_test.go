@@ -0,0 +1,162 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestLoadPolicyConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "policy.yaml")
+	config := []byte("runAsUser: 2000\nrunAsGroup: 3000\n")
+	if err := os.WriteFile(configFile, config, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	exemptionsFile := filepath.Join(t.TempDir(), "exemptions.yaml")
+	exemptions := []byte("exemptions:\n  serviceAccounts:\n  - monitoring/node-exporter\n")
+	if err := os.WriteFile(exemptionsFile, exemptions, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	versionedFile := filepath.Join(t.TempDir(), "versioned.yaml")
+	versioned := []byte("apiVersion: think8shook.io/v1alpha1\nkind: HardeningPolicy\nspec:\n  runAsUser: 2000\n  restricted: true\n")
+	if err := os.WriteFile(versionedFile, versioned, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	invalidFile := filepath.Join(t.TempDir(), "invalid.yaml")
+	invalid := []byte("exemptions:\n  serviceAccounts:\n  - node-exporter\n")
+	if err := os.WriteFile(invalidFile, invalid, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name     string
+		path     string
+		args     []string
+		expected policyConfig
+		wantErr  bool
+	}{
+		{
+			name:     "defaults",
+			expected: defaultPolicyConfig(),
+		},
+		{
+			name: "config file",
+			path: configFile,
+			expected: func() policyConfig {
+				cfg := defaultPolicyConfig()
+				cfg.RunAsUser = 2000
+				cfg.RunAsGroup = 3000
+				return cfg
+			}(),
+		},
+		{
+			name: "flags override config file",
+			path: configFile,
+			args: []string{"--run-as-user", "5000", "--fs-group", "6000"},
+			expected: func() policyConfig {
+				cfg := defaultPolicyConfig()
+				cfg.RunAsUser = 5000
+				cfg.RunAsGroup = 3000
+				cfg.FSGroup = 6000
+				return cfg
+			}(),
+		},
+		{
+			name: "localhost profile",
+			args: []string{"--seccomp-profile", "Localhost", "--seccomp-localhost-profile", "audit.json"},
+			expected: func() policyConfig {
+				cfg := defaultPolicyConfig()
+				profile := "audit.json"
+				cfg.SeccompProfile = corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: &profile}
+				return cfg
+			}(),
+		},
+		{
+			name: "allowed capabilities",
+			args: []string{"--allowed-capabilities", "NET_BIND_SERVICE, NET_RAW"},
+			expected: func() policyConfig {
+				cfg := defaultPolicyConfig()
+				cfg.AllowedCapabilities = []corev1.Capability{"NET_BIND_SERVICE", "NET_RAW"}
+				return cfg
+			}(),
+		},
+		{
+			name:    "localhost profile missing",
+			args:    []string{"--seccomp-profile", "Localhost"},
+			wantErr: true,
+		},
+		{
+			name:    "negative uid",
+			args:    []string{"--run-as-user", "-1"},
+			wantErr: true,
+		},
+		{
+			name: "exemptions replace the defaults",
+			path: exemptionsFile,
+			expected: func() policyConfig {
+				cfg := defaultPolicyConfig()
+				cfg.Exemptions = exemptionConfig{ServiceAccounts: []string{"monitoring/node-exporter"}}
+				return cfg
+			}(),
+		},
+		{
+			name: "versioned policy",
+			path: versionedFile,
+			expected: func() policyConfig {
+				cfg := defaultPolicyConfig()
+				cfg.RunAsUser = 2000
+				cfg.Restricted = true
+				return cfg
+			}(),
+		},
+		{
+			name:    "invalid exempted service account",
+			path:    invalidFile,
+			wantErr: true,
+		},
+		{
+			name:    "missing config file",
+			path:    filepath.Join(t.TempDir(), "missing.yaml"),
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				flags policyConfig
+				path  string
+			)
+			fs := pflag.NewFlagSet(tc.name, pflag.ContinueOnError)
+			addPolicyFlags(fs, &flags, &path)
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := loadPolicyConfig(tc.path, fs, flags)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, cfg)
+		})
+	}
+}
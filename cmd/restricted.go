@@ -0,0 +1,124 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	psaapi "k8s.io/pod-security-admission/api"
+	psapolicy "k8s.io/pod-security-admission/policy"
+)
+
+// pssRestrictedCapabilities are the only capabilities the restricted
+// Pod Security Standard allows containers to add
+var pssRestrictedCapabilities = []corev1.Capability{"NET_BIND_SERVICE"}
+
+// restrictedCapabilities returns the allowed capabilities that the
+// restricted level also allows
+func restrictedCapabilities(allowed []corev1.Capability) []corev1.Capability {
+	return slices.DeleteFunc(slices.Clone(allowed), func(capability corev1.Capability) bool {
+		return !slices.Contains(pssRestrictedCapabilities, capability)
+	})
+}
+
+// restrictedLevel is the Pod Security Standard level enforced in restricted mode
+var restrictedLevel = psaapi.LevelVersion{
+	Level:   psaapi.LevelRestricted,
+	Version: psaapi.LatestVersion(),
+}
+
+// pssEvaluator evaluates pods with the upstream Pod Security Standards checks
+var pssEvaluator = mustNewEvaluator()
+
+func mustNewEvaluator() psapolicy.Evaluator {
+	evaluator, err := psapolicy.NewEvaluator(psapolicy.DefaultChecks())
+	if err != nil {
+		panic(err)
+	}
+	return evaluator
+}
+
+// restrictPodSecurityContext changes the pod-level settings not allowed
+// by the restricted level. Returns true if sc was modified.
+func restrictPodSecurityContext(sc *corev1.PodSecurityContext) bool {
+	if sc.SeccompProfile != nil && sc.SeccompProfile.Type == corev1.SeccompProfileTypeUnconfined {
+		sc.SeccompProfile = &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		}
+		return true
+	}
+	return false
+}
+
+// restrictContainerSecurityContext changes the container-level settings not
+// allowed by the restricted level, keeping only the added capabilities in
+// allowed. Returns true if sc was modified.
+func restrictContainerSecurityContext(sc *corev1.SecurityContext, allowed []corev1.Capability) bool {
+	modified := false
+	if sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+		allowPrivilegeEscalation := false
+		sc.AllowPrivilegeEscalation = &allowPrivilegeEscalation
+		modified = true
+	}
+	// Unconfined profile at container level overrides the pod one
+	if sc.SeccompProfile != nil && sc.SeccompProfile.Type == corev1.SeccompProfileTypeUnconfined {
+		sc.SeccompProfile = nil
+		modified = true
+	}
+	if sc.Capabilities == nil {
+		sc.Capabilities = &corev1.Capabilities{}
+	}
+	if !slices.Contains(sc.Capabilities.Drop, "ALL") {
+		sc.Capabilities.Drop = append(sc.Capabilities.Drop, "ALL")
+		modified = true
+	}
+	if len(sc.Capabilities.Add) > 0 {
+		add := make([]corev1.Capability, 0, len(sc.Capabilities.Add))
+		for _, capability := range sc.Capabilities.Add {
+			if slices.Contains(allowed, capability) {
+				add = append(add, capability)
+			}
+		}
+		if len(add) != len(sc.Capabilities.Add) {
+			if len(add) == 0 {
+				add = nil
+			}
+			sc.Capabilities.Add = add
+			modified = true
+		}
+	}
+	return modified
+}
+
+// restrictedWarnings evaluates the pod against the restricted level and
+// returns one warning per failing check
+func restrictedWarnings(pod *corev1.Pod) []string {
+	var warnings []string
+	for _, result := range pssEvaluator.EvaluatePod(restrictedLevel, &pod.ObjectMeta, &pod.Spec) {
+		if result.Allowed {
+			continue
+		}
+		warning := fmt.Sprintf("would violate PodSecurity %q: %s", restrictedLevel.String(), result.ForbiddenReason)
+		if result.ForbiddenDetail != "" {
+			warning = fmt.Sprintf("%s (%s)", warning, result.ForbiddenDetail)
+		}
+		warnings = append(warnings, warning)
+	}
+	return warnings
+}
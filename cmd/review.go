@@ -0,0 +1,160 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/warpcomdev/think8shook/internal/webhook"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	v1 "k8s.io/api/admission/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// reviewOptions are the flags of the review subcommand
+type reviewOptions struct {
+	policyFile string
+	policy     policyConfig
+	path       string
+}
+
+var reviewFlags reviewOptions
+
+// CmdReview replays a captured AdmissionReview against the webhook handlers
+var CmdReview = &cobra.Command{
+	Use:   "review [file]",
+	Short: "Replays a captured AdmissionReview against the webhook",
+	Long: `Replays an AdmissionReview (admission.k8s.io/v1 or v1beta1) read from a file, or stdin
+if no file or "-" is given, through the same HTTP handler the server registers for --path.
+Prints the AdmissionReview response and, if the request was patched, the patched object.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		cfg, err := loadPolicyConfig(reviewFlags.policyFile, cmd.Flags(), reviewFlags.policy)
+		if err != nil {
+			return err
+		}
+		policy = cfg
+		input := "-"
+		if len(args) > 0 {
+			input = args[0]
+		}
+		var data []byte
+		if input == "-" {
+			data, err = io.ReadAll(cmd.InOrStdin())
+		} else {
+			data, err = os.ReadFile(input)
+		}
+		if err != nil {
+			return err
+		}
+		return reviewFlags.run(data, cmd.OutOrStdout())
+	},
+}
+
+func init() {
+	addPolicyFlags(CmdReview.Flags(), &reviewFlags.policy, &reviewFlags.policyFile)
+	CmdReview.Flags().StringVar(&reviewFlags.path, "path", admissionEndpoints[0].path,
+		"Admission endpoint to send the review to.")
+	CmdWebhook.AddCommand(CmdReview)
+}
+
+// run sends the review to the endpoint handler and prints the response
+// and the patched object as YAML documents
+func (o reviewOptions) run(data []byte, out io.Writer) error {
+	handler, err := o.handler()
+	if err != nil {
+		return err
+	}
+	// The API server always sends JSON, but captures may have been converted
+	body, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return err
+	}
+	var request v1.AdmissionReview
+	if err := json.Unmarshal(body, &request); err != nil {
+		return err
+	}
+	if request.Request == nil {
+		return fmt.Errorf("admission review has no request")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, o.path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		return fmt.Errorf("%s returned %d: %s", o.path, recorder.Code, bytes.TrimSpace(recorder.Body.Bytes()))
+	}
+	if recorder.Body.Len() == 0 {
+		return fmt.Errorf("%s returned an empty response", o.path)
+	}
+
+	// v1 and v1beta1 responses share the same JSON layout
+	var response v1.AdmissionReview
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		return err
+	}
+	reviewYAML, err := yaml.JSONToYAML(recorder.Body.Bytes())
+	if err != nil {
+		return err
+	}
+	if response.Response != nil && len(response.Response.Patch) > 0 {
+		if _, err := fmt.Fprintf(out, "# patch: %s\n", response.Response.Patch); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(out, "---\n%s", reviewYAML); err != nil {
+		return err
+	}
+	if response.Response == nil || len(response.Response.Patch) == 0 {
+		return nil
+	}
+	patch, err := jsonpatch.DecodePatch(response.Response.Patch)
+	if err != nil {
+		return err
+	}
+	patched, err := patch.Apply(request.Request.Object.Raw)
+	if err != nil {
+		return fmt.Errorf("failed to apply the patch to the request object: %w", err)
+	}
+	patchedYAML, err := yaml.JSONToYAML(patched)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "---\n%s", patchedYAML)
+	return err
+}
+
+// handler returns the handler the server registers for the path
+func (o reviewOptions) handler() (http.Handler, error) {
+	paths := make([]string, 0, len(admissionEndpoints))
+	for _, endpoint := range admissionEndpoints {
+		if endpoint.path == o.path {
+			return endpoint.handler(webhook.Codecs()), nil
+		}
+		paths = append(paths, endpoint.path)
+	}
+	return nil, fmt.Errorf("unknown path %q, must be one of %v", o.path, paths)
+}
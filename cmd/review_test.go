@@ -0,0 +1,106 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+func TestReview(t *testing.T) {
+	policy = defaultPolicyConfig()
+	privileged := true
+	pod := corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:            "web",
+			Image:           "nginx",
+			SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+		}}},
+	}
+	request := v1.AdmissionRequest{
+		UID:       "b2f1c4a0-0000-0000-0000-000000000001",
+		Resource:  podsResource,
+		Namespace: "default",
+		Name:      "web",
+		Operation: v1.Create,
+		Object:    runtime.RawExtension{Raw: mustMarshal(pod)},
+	}
+
+	t.Run("v1 mutating review", func(t *testing.T) {
+		review := v1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			Request:  &request,
+		}
+		// Captures are accepted as YAML too
+		data, err := yaml.Marshal(review)
+		require.NoError(t, err)
+		var out bytes.Buffer
+		require.NoError(t, reviewOptions{path: "/mutating-pods"}.run(data, &out))
+
+		documents := strings.Split(out.String(), "---\n")
+		require.Len(t, documents, 3)
+		require.True(t, strings.HasPrefix(documents[0], "# patch: ["))
+		var response v1.AdmissionReview
+		require.NoError(t, yaml.Unmarshal([]byte(documents[1]), &response))
+		require.Equal(t, request.UID, response.Response.UID)
+		require.True(t, response.Response.Allowed)
+		var patched corev1.Pod
+		require.NoError(t, yaml.Unmarshal([]byte(documents[2]), &patched))
+		require.Equal(t, int64(1000), *patched.Spec.SecurityContext.RunAsUser)
+		require.Nil(t, patched.Spec.Containers[0].SecurityContext.Privileged)
+	})
+
+	t.Run("v1beta1 validating review", func(t *testing.T) {
+		review := v1beta1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+			Request: &v1beta1.AdmissionRequest{
+				UID:       request.UID,
+				Resource:  request.Resource,
+				Namespace: request.Namespace,
+				Name:      request.Name,
+				Operation: v1beta1.Create,
+				Object:    request.Object,
+			},
+		}
+		var out bytes.Buffer
+		require.NoError(t, reviewOptions{path: "/validating-pods"}.run(mustMarshal(review), &out))
+		documents := strings.Split(out.String(), "---\n")
+		require.Len(t, documents, 2)
+		var response v1beta1.AdmissionReview
+		require.NoError(t, yaml.Unmarshal([]byte(documents[1]), &response))
+		require.Equal(t, "admission.k8s.io/v1beta1", response.APIVersion)
+		require.False(t, response.Response.Allowed)
+		require.Contains(t, response.Response.Result.Message, `container "web" is privileged`)
+	})
+
+	t.Run("unknown path", func(t *testing.T) {
+		review := v1.AdmissionReview{Request: &request}
+		err := reviewOptions{path: "/mutating-deployments"}.run(mustMarshal(review), &bytes.Buffer{})
+		require.ErrorContains(t, err, "unknown path")
+	})
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/klog/v2"
+)
+
+// rulesAuditKey is the audit annotation listing the rules applied
+const rulesAuditKey = "rules"
+
+// mutationRule is a named hardening rule of the mutating webhook. Rules
+// edit the pod or the containers in place; the patch, audit annotations
+// and metrics are generated by the ruleSet that runs them.
+type mutationRule struct {
+	name string
+	// filter returns false if the rule does not apply to the pod.
+	// A nil filter applies the rule to every pod.
+	filter podFilterFunc
+	// bind returns the rule specialised for the request, or false if
+	// the rule does not apply. May be nil.
+	bind func(rc *ruleContext) (mutationRule, bool, error)
+	// pod mutates the pod-level fields, may be nil
+	pod podSpecMutateFunc
+	// container mutates each container, may be nil
+	container containerMutateFunc
+}
+
+// builtinRules are the rules implemented in code, that policies
+// refer to by name
+var builtinRules = ruleSet{
+	{name: "run-as-non-root", pod: injectRunAsNonRoot},
+	{name: "restricted-pod", filter: isRestricted, pod: restrictPod},
+	{name: "remove-privileged", container: removePrivileged},
+	{name: "remove-privilege-escalation", container: removePrivilegeEscalation},
+	{name: "drop-capabilities", container: dropCapabilities},
+	{name: "restricted-container", filter: isRestricted, container: restrictContainer},
+}
+
+// defaultRules are the rules declared by the embedded default policy
+var defaultRules = sync.OnceValue(func() ruleSet {
+	cfg, err := decodeHardeningPolicy(defaultPolicyYAML, policyConfig{})
+	if err != nil {
+		panic(fmt.Errorf("invalid default policy: %w", err))
+	}
+	rules, err := compileMutations(cfg.Mutations, builtinRules)
+	if err != nil {
+		panic(fmt.Errorf("invalid default policy: %w", err))
+	}
+	return rules
+})
+
+// errUnbound is returned by the rules that must be bound to the request
+var errUnbound = errors.New("rule not bound to the request")
+
+// policyBuiltins returns the rules policies can run by name: the ones
+// implemented in code and the ones declared by the default policy, so
+// that policies declaring their own mutations can keep the defaults
+func policyBuiltins() ruleSet {
+	builtins := slices.Clone(builtinRules)
+	for _, rule := range defaultRules() {
+		if _, ok := builtins.find(rule.name); !ok {
+			builtins = append(builtins, rule)
+		}
+	}
+	return builtins
+}
+
+// ruleSet runs a list of rules in order. The pod-level edits of all the
+// rules run before the container-level ones.
+type ruleSet []mutationRule
+
+// names returns the names of the rules, in order
+func (rs ruleSet) names() []string {
+	names := make([]string, 0, len(rs))
+	for _, rule := range rs {
+		names = append(names, rule.name)
+	}
+	return names
+}
+
+// find returns the rule with the given name
+func (rs ruleSet) find(name string) (mutationRule, bool) {
+	idx := slices.IndexFunc(rs, func(rule mutationRule) bool { return rule.name == name })
+	if idx < 0 {
+		return mutationRule{}, false
+	}
+	return rs[idx], true
+}
+
+// checkOrder returns an error if a rule mutating the pod is listed after
+// one mutating the containers, since that order can not be honoured
+func (rs ruleSet) checkOrder() error {
+	for idx, rule := range rs {
+		if rule.container == nil {
+			continue
+		}
+		for _, later := range rs[idx+1:] {
+			if later.pod != nil {
+				return fmt.Errorf("mutation rule %q mutates the pod and must be listed before %q, that mutates the containers", later.name, rule.name)
+			}
+		}
+	}
+	return nil
+}
+
+// declaredRules returns the rules declared by the policy mutations,
+// or the default ones if the policy does not declare any
+func (cfg policyConfig) declaredRules() ruleSet {
+	if cfg.compiled != nil {
+		return cfg.compiled
+	}
+	if len(cfg.Mutations) == 0 {
+		return defaultRules()
+	}
+	// policies are compiled by loadPolicyConfig, this is only reached
+	// by the ones decoded elsewhere, like the test fixtures.
+	rules, err := compileMutations(cfg.Mutations, policyBuiltins())
+	if err != nil {
+		klog.Errorf("ignoring invalid mutations: %v", err)
+	}
+	return rules
+}
+
+// enabledRules returns the rules enabled by the policy, in the configured order
+func (cfg policyConfig) enabledRules() ruleSet {
+	declared := cfg.declaredRules()
+	names := cfg.Rules
+	if len(names) == 0 {
+		names = declared.names()
+	}
+	rules := make(ruleSet, 0, len(names))
+	for _, name := range names {
+		if slices.Contains(cfg.DisabledRules, name) {
+			continue
+		}
+		// names are checked by policyConfig.validate
+		if rule, ok := declared.find(name); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// ruleContext is the request the rules are bound to. The policy values
+// and CEL variables are computed on first use, and shared by the rules.
+type ruleContext struct {
+	req    *v1.AdmissionRequest
+	pod    *corev1.Pod
+	values func() (map[string]interface{}, error)
+	vars   func() (map[string]interface{}, error)
+}
+
+func newRuleContext(req *v1.AdmissionRequest, pod *corev1.Pod) *ruleContext {
+	return &ruleContext{
+		req:    req,
+		pod:    pod,
+		values: sync.OnceValues(func() (map[string]interface{}, error) { return policyValues(pod.Namespace) }),
+		vars:   sync.OnceValues(func() (map[string]interface{}, error) { return celVariables(req, pod) }),
+	}
+}
+
+// forPod returns the rules whose filter matches the pod, bound to it
+func (rs ruleSet) forPod(req *v1.AdmissionRequest, pod *corev1.Pod) (ruleSet, error) {
+	rc := newRuleContext(req, pod)
+	matched := make(ruleSet, 0, len(rs))
+	for _, rule := range rs {
+		if rule.filter != nil && !rule.filter(req, pod) {
+			continue
+		}
+		if rule.bind != nil {
+			bound, ok, err := rule.bind(rc)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			rule = bound
+		}
+		matched = append(matched, rule)
+	}
+	return matched, nil
+}
+
+// mutatePod runs the pod-level rules and audits the resulting changes
+func (rs ruleSet) mutatePod(pod *corev1.Pod, ps *patchSet) error {
+	before := pod.Spec.SecurityContext.DeepCopy()
+	for _, rule := range rs {
+		if rule.pod == nil {
+			continue
+		}
+		snapshot := pod.DeepCopy()
+		if err := rule.pod(pod, ps); err != nil {
+			return fmt.Errorf("rule %s: %w", rule.name, err)
+		}
+		if err := ps.recordRule(rule.name, "", snapshot, pod); err != nil {
+			return err
+		}
+	}
+	if after := pod.Spec.SecurityContext; after != nil && !apiequality.Semantic.DeepEqual(before, after) {
+		auditPodSecurityContext("/spec/securityContext", before, after, ps)
+	}
+	return nil
+}
+
+// mutateContainer runs the container-level rules and audits the resulting changes
+func (rs ruleSet) mutateContainer(path string, container *corev1.Container, ps *patchSet) error {
+	before := container.SecurityContext.DeepCopy()
+	for _, rule := range rs {
+		if rule.container == nil {
+			continue
+		}
+		snapshot := container.DeepCopy()
+		if err := rule.container(path, container, ps); err != nil {
+			return fmt.Errorf("rule %s: %w", rule.name, err)
+		}
+		if err := ps.recordRule(rule.name, path, snapshot, container); err != nil {
+			return err
+		}
+	}
+	if after := container.SecurityContext; after != nil && !apiequality.Semantic.DeepEqual(before, after) {
+		auditContainerSecurityContext(path+"/securityContext", container.Name, before, after, ps)
+	}
+	return nil
+}
+
+// mutateRules applies the rules enabled by the policy. The pod-level
+// rules run first, policyConfig.validate rejects any other order.
+func mutateRules(req *v1.AdmissionRequest, pod *corev1.Pod, ps *patchSet) error {
+	warnOutsideRanges(pod)
+	rules, err := policy.enabledRules().forPod(req, pod)
+	if err != nil {
+		return err
+	}
+	return podMutator(rules.mutatePod, rules.mutateContainer)(req, pod, ps)
+}
+
+// isRestricted enables the rules of the restricted mode
+func isRestricted(req *v1.AdmissionRequest, pod *corev1.Pod) bool {
+	return policyForNamespace(pod.Namespace).Restricted
+}
+
+// injectRunAsNonRoot sets runAsNonRoot unless the pod runs as root
+func injectRunAsNonRoot(pod *corev1.Pod, ps *patchSet) error {
+	sc := pod.Spec.SecurityContext
+	if sc == nil {
+		sc = &corev1.PodSecurityContext{}
+	}
+	if sc.RunAsNonRoot == nil {
+		var nonRoot = (sc.RunAsUser == nil || *sc.RunAsUser != 0)
+		sc.RunAsNonRoot = &nonRoot
+		pod.Spec.SecurityContext = sc
+	}
+	return nil
+}
+
+// restrictPod changes the pod-level settings not allowed by the restricted level
+func restrictPod(pod *corev1.Pod, ps *patchSet) error {
+	if pod.Spec.SecurityContext != nil {
+		restrictPodSecurityContext(pod.Spec.SecurityContext)
+	}
+	return nil
+}
+
+// removePrivileged removes privileged=true from the container
+func removePrivileged(path string, container *corev1.Container, ps *patchSet) error {
+	if sc := container.SecurityContext; sc != nil && sc.Privileged != nil && *sc.Privileged {
+		sc.Privileged = nil
+	}
+	return nil
+}
+
+// removePrivilegeEscalation removes allowPrivilegeEscalation=true from the container
+func removePrivilegeEscalation(path string, container *corev1.Container, ps *patchSet) error {
+	if sc := container.SecurityContext; sc != nil && sc.AllowPrivilegeEscalation != nil && *sc.AllowPrivilegeEscalation {
+		sc.AllowPrivilegeEscalation = nil
+	}
+	return nil
+}
+
+// dropCapabilities drops all capabilities if the container does not set any
+func dropCapabilities(path string, container *corev1.Container, ps *patchSet) error {
+	if container.SecurityContext == nil {
+		container.SecurityContext = &corev1.SecurityContext{}
+	}
+	if container.SecurityContext.Capabilities == nil {
+		container.SecurityContext.Capabilities = &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		}
+	}
+	return nil
+}
+
+// restrictContainer changes the container-level settings not allowed by the restricted level
+func restrictContainer(path string, container *corev1.Container, ps *patchSet) error {
+	if container.SecurityContext == nil {
+		container.SecurityContext = &corev1.SecurityContext{}
+	}
+	restrictContainerSecurityContext(container.SecurityContext, restrictedCapabilities(policy.AllowedCapabilities))
+	return nil
+}
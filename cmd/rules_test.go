@@ -0,0 +1,177 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+	"github.com/warpcomdev/think8shook/internal/webhook"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestMutationRules(t *testing.T) {
+	privileged := true
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:            "test",
+			Image:           "busybox/latest",
+			SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+		}}},
+	}
+	testCases := []struct {
+		name     string
+		rules    []string
+		disabled []string
+		paths    []string
+		applied  string
+	}{
+		{
+			name: "default rules",
+			paths: []string{
+				"/spec/securityContext",
+				"/spec/containers/0/securityContext/capabilities",
+				"/spec/containers/0/securityContext/privileged",
+			},
+			applied: "pod-identity,run-as-non-root,seccomp-profile,remove-privileged,drop-capabilities",
+		},
+		{
+			name:     "disabled rules",
+			disabled: []string{"remove-privileged", "drop-capabilities"},
+			paths:    []string{"/spec/securityContext"},
+			applied:  "pod-identity,run-as-non-root,seccomp-profile",
+		},
+		{
+			name:  "ordered rules",
+			rules: []string{"seccomp-profile", "pod-identity", "remove-privileged"},
+			paths: []string{
+				"/spec/securityContext",
+				"/spec/containers/0/securityContext/privileged",
+			},
+			applied: "seccomp-profile,pod-identity,remove-privileged",
+		},
+		{
+			name:    "rules enabled and disabled",
+			rules:   []string{"run-as-non-root", "remove-privileged"},
+			paths:   []string{"/spec/securityContext"},
+			applied: "run-as-non-root",
+			// the disabled rule wins
+			disabled: []string{"remove-privileged"},
+		},
+	}
+	defer func() { policy = defaultPolicyConfig() }()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy = defaultPolicyConfig()
+			policy.Rules = tc.rules
+			policy.DisabledRules = tc.disabled
+			require.NoError(t, policy.validate())
+			ps := &patchSet{}
+			require.NoError(t, mutateRules(nil, pod.DeepCopy(), ps))
+			paths := make([]string, 0, len(ps.patches))
+			for _, patch := range ps.patches {
+				paths = append(paths, patch.Path)
+			}
+			require.Equal(t, tc.paths, paths)
+			require.Equal(t, tc.applied, ps.auditAnnotations()[rulesAuditKey])
+		})
+	}
+}
+
+func TestRestrictedRulesFilter(t *testing.T) {
+	defer func() { policy = defaultPolicyConfig() }()
+	policy = defaultPolicyConfig()
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "test"}}}}
+	rules, err := policy.enabledRules().forPod(nil, pod)
+	require.NoError(t, err)
+	require.NotContains(t, rules.names(), "restricted-container")
+	policy.Restricted = true
+	rules, err = policy.enabledRules().forPod(nil, pod)
+	require.NoError(t, err)
+	require.Contains(t, rules.names(), "restricted-container")
+}
+
+func TestRestrictedCapabilities(t *testing.T) {
+	defer func() { policy = defaultPolicyConfig() }()
+	add := []corev1.Capability{"NET_BIND_SERVICE", "NET_RAW"}
+	restricted := func() []corev1.Capability {
+		container := &corev1.Container{SecurityContext: &corev1.SecurityContext{
+			Capabilities: &corev1.Capabilities{Add: slices.Clone(add)},
+		}}
+		require.NoError(t, restrictContainer("", container, &patchSet{}))
+		return container.SecurityContext.Capabilities.Add
+	}
+	// NET_RAW is not allowed by the restricted level, even if the policy does
+	policy = defaultPolicyConfig()
+	policy.AllowedCapabilities = add
+	require.Equal(t, []corev1.Capability{"NET_BIND_SERVICE"}, restricted())
+	// and NET_BIND_SERVICE is removed if the policy does not allow it
+	policy.AllowedCapabilities = nil
+	require.Empty(t, restricted())
+}
+
+func TestMutationRulesConfig(t *testing.T) {
+	cfg := defaultPolicyConfig()
+	cfg.Rules = []string{"pod-identity", "no-such-rule", "pod-identity"}
+	cfg.DisabledRules = []string{"other-rule"}
+	err := cfg.validate()
+	require.ErrorContains(t, err, `unknown mutation rule "no-such-rule"`)
+	require.ErrorContains(t, err, `mutation rule "pod-identity" is listed more than once`)
+	require.ErrorContains(t, err, `unknown disabled mutation rule "other-rule"`)
+
+	// Pod rules can not be listed after container rules
+	cfg = defaultPolicyConfig()
+	cfg.Rules = []string{"seccomp-profile", "remove-privileged", "pod-identity"}
+	require.ErrorContains(t, cfg.validate(), `mutation rule "pod-identity" mutates the pod and must be listed before "remove-privileged"`)
+	cfg.DisabledRules = []string{"pod-identity"}
+	require.NoError(t, cfg.validate())
+
+	var flags policyConfig
+	var path string
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	addPolicyFlags(fs, &flags, &path)
+	require.NoError(t, fs.Parse([]string{"--rules", "pod-identity,drop-capabilities", "--disable-rules", "pod-identity"}))
+	cfg, err = loadPolicyConfig("", fs, flags)
+	require.NoError(t, err)
+	require.Equal(t, []string{"pod-identity", "drop-capabilities"}, cfg.Rules)
+	require.Equal(t, []string{"drop-capabilities"}, cfg.enabledRules().names())
+}
+
+func TestRuleMetrics(t *testing.T) {
+	policy = defaultPolicyConfig()
+	pod := corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "a"}, {Name: "b"}}}}
+	ar := v1.AdmissionReview{Request: &v1.AdmissionRequest{
+		Resource:  podsResource,
+		Namespace: "default",
+		Operation: v1.Create,
+		Object:    runtime.RawExtension{Raw: mustMarshal(pod)},
+	}}
+	identity := testutil.ToFloat64(ruleMutations.WithLabelValues("pod-identity"))
+	capabilities := testutil.ToFloat64(ruleMutations.WithLabelValues("drop-capabilities"))
+	response := mutateSecurityContext(ar, webhook.Codecs())
+	require.NotNil(t, response.Patch)
+	require.Equal(t, identity+1, testutil.ToFloat64(ruleMutations.WithLabelValues("pod-identity")))
+	// counted once per container
+	require.Equal(t, capabilities+2, testutil.ToFloat64(ruleMutations.WithLabelValues("drop-capabilities")))
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Defaults for the graceful shutdown
+const (
+	defaultDrainPeriod     = 10 * time.Second
+	defaultShutdownTimeout = 20 * time.Second
+)
+
+// shuttingDown is set when the server starts draining,
+// so that readiness probes fail
+var shuttingDown atomic.Bool
+
+// checkShutdown fails once the server starts shutting down
+func checkShutdown() error {
+	if shuttingDown.Load() {
+		return errors.New("shutting down")
+	}
+	return nil
+}
+
+// serveUntilDone runs serve until ctx is done. Then it fails the readiness
+// probe, waits for the drain period so that the API server stops sending
+// requests, and shuts the server down letting in-flight requests finish.
+func serveUntilDone(ctx context.Context, server *http.Server, serve func() error, drainPeriod, shutdownTimeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- serve()
+	}()
+	select {
+	case err := <-errCh:
+		// The server failed before any shutdown was requested
+		return err
+	case <-ctx.Done():
+	}
+	shuttingDown.Store(true)
+	klog.Infof("shutting down, draining connections for %s", drainPeriod)
+	time.Sleep(drainPeriod)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	klog.Info("server stopped")
+	return nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	defer shuttingDown.Store(false)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- serveUntilDone(ctx, server, func() error { return server.Serve(listener) }, 200*time.Millisecond, 5*time.Second)
+	}()
+
+	// Start a request that is still in flight when the shutdown begins
+	type result struct {
+		body string
+		err  error
+	}
+	inFlight := make(chan result)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			inFlight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		inFlight <- result{body: string(body), err: err}
+	}()
+	<-started
+
+	readyz := serveHealth(&healthChecks{checks: []healthCheck{{name: "shutdown", check: checkShutdown}}})
+	probe := func() int {
+		rec := httptest.NewRecorder()
+		readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+	require.Equal(t, http.StatusOK, probe())
+
+	// Readiness fails as soon as the shutdown begins
+	cancel()
+	require.Eventually(t, func() bool {
+		return probe() == http.StatusServiceUnavailable
+	}, time.Second, 10*time.Millisecond)
+
+	// The in-flight request is allowed to finish
+	close(release)
+	r := <-inFlight
+	require.NoError(t, r.err)
+	require.Equal(t, "done", r.body)
+	require.NoError(t, <-done)
+}
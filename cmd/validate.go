@@ -0,0 +1,162 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/warpcomdev/think8shook/internal/webhook"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/klog/v2"
+)
+
+// podValidatorFunc returns the list of violations found in the pod
+type podValidatorFunc func(pod *corev1.Pod) []string
+
+// podValidation analizes admission request and rejects pods with violations
+func podValidation(ar v1.AdmissionReview, codecs *serializer.CodecFactory, filter podFilterFunc, validator podValidatorFunc) *v1.AdmissionResponse {
+	klog.V(2).Info("validating pods")
+	outcome := outcomeError
+	defer func() { countRequest(validatingWebhook, ar.Request, outcome) }()
+	if ar.Request.Resource != podsResource {
+		err := fmt.Errorf("expect resource to be %s", podsResource)
+		klog.Error(err)
+		return webhook.V1AdmissionError(err)
+	}
+	// Running pods were validated on creation and their spec is immutable,
+	// so updates are only checked for the ephemeral containers they add.
+	if !isMutableOperation(ar.Request) {
+		outcome = outcomeAllowed
+		return &v1.AdmissionResponse{Allowed: true}
+	}
+	if ar.Request.Operation == v1.Update && ar.Request.SubResource != ephemeralContainersSubresource {
+		outcome = outcomeAllowed
+		return &v1.AdmissionResponse{Allowed: true}
+	}
+
+	raw := ar.Request.Object.Raw
+	pod := corev1.Pod{}
+	deserializer := codecs.UniversalDeserializer()
+	if _, _, err := deserializer.Decode(raw, nil, &pod); err != nil {
+		klog.Error(err)
+		decodeErrors.Inc()
+		return webhook.V1AdmissionError(err)
+	}
+	if ar.Request.SubResource == ephemeralContainersSubresource {
+		oldPod := corev1.Pod{}
+		if _, _, err := deserializer.Decode(ar.Request.OldObject.Raw, nil, &oldPod); err != nil {
+			klog.Error(err)
+			decodeErrors.Inc()
+			return webhook.V1AdmissionError(err)
+		}
+		added := make([]corev1.EphemeralContainer, 0, 1)
+		for _, idx := range newEphemeralContainers(&oldPod, &pod) {
+			added = append(added, pod.Spec.EphemeralContainers[idx])
+		}
+		pod.Spec = corev1.PodSpec{EphemeralContainers: added}
+	}
+	reviewResponse := v1.AdmissionResponse{}
+	reviewResponse.Allowed = true
+	if !filter(ar.Request, &pod) {
+		outcome = outcomeSkipped
+		return &reviewResponse
+	}
+	outcome = outcomeAllowed
+	if violations := validator(&pod); len(violations) > 0 {
+		msg := fmt.Sprintf("pod violates the ThinK8S baseline: %s", strings.Join(violations, "; "))
+		klog.V(2).Infof("rejecting pod %s/%s: %s", ar.Request.Namespace, ar.Request.Name, msg)
+		reviewResponse.Allowed = false
+		outcome = outcomeDenied
+		reviewResponse.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonForbidden,
+			Code:    http.StatusForbidden,
+			Message: msg,
+		}
+	}
+	return &reviewResponse
+}
+
+// validatePodSecurityContext returns every violation of the ThinK8S baseline
+func validatePodSecurityContext(pod *corev1.Pod) []string {
+	var violations []string
+	if pod.Spec.HostNetwork {
+		violations = append(violations, "hostNetwork is not allowed")
+	}
+	if pod.Spec.HostPID {
+		violations = append(violations, "hostPID is not allowed")
+	}
+	if pod.Spec.HostIPC {
+		violations = append(violations, "hostIPC is not allowed")
+	}
+	if sc := pod.Spec.SecurityContext; sc != nil && sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+		violations = append(violations, "pod runs as root (runAsUser=0)")
+	}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.HostPath != nil {
+			violations = append(violations, fmt.Sprintf("volume %q uses hostPath", volume.Name))
+		}
+	}
+	validateContainers := func(kind string, containers []corev1.Container) {
+		for _, container := range containers {
+			violations = append(violations, validateContainerSecurityContext(kind, &container)...)
+		}
+	}
+	validateContainers("initContainer", pod.Spec.InitContainers)
+	validateContainers("container", pod.Spec.Containers)
+	for _, ec := range pod.Spec.EphemeralContainers {
+		container := corev1.Container(ec.EphemeralContainerCommon)
+		violations = append(violations, validateContainerSecurityContext("ephemeralContainer", &container)...)
+	}
+	return violations
+}
+
+// validateContainerSecurityContext returns the violations of a single container
+func validateContainerSecurityContext(kind string, container *corev1.Container) []string {
+	sc := container.SecurityContext
+	if sc == nil {
+		return nil
+	}
+	var violations []string
+	if sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+		violations = append(violations, fmt.Sprintf("%s %q runs as root (runAsUser=0)", kind, container.Name))
+	}
+	if sc.Privileged != nil && *sc.Privileged {
+		violations = append(violations, fmt.Sprintf("%s %q is privileged", kind, container.Name))
+	}
+	if sc.AllowPrivilegeEscalation != nil && *sc.AllowPrivilegeEscalation {
+		violations = append(violations, fmt.Sprintf("%s %q allows privilege escalation", kind, container.Name))
+	}
+	if sc.Capabilities != nil {
+		for _, capability := range sc.Capabilities.Add {
+			if !slices.Contains(policy.AllowedCapabilities, capability) {
+				violations = append(violations, fmt.Sprintf("%s %q adds capability %s, allowed capabilities are %v", kind, container.Name, capability, policy.AllowedCapabilities))
+			}
+		}
+	}
+	return violations
+}
+
+func validateSecurityContext(ar v1.AdmissionReview, codecs *serializer.CodecFactory) *v1.AdmissionResponse {
+	return podValidation(ar, codecs, shouldMutateSecurityContext, validatePodSecurityContext)
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/warpcomdev/think8shook/internal/webhook"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestValidateSecurityContext(t *testing.T) {
+	root := int64(0)
+	testCases := []struct {
+		name    string
+		pod     corev1.Pod
+		allowed bool
+		message string
+	}{
+		{
+			name:    "compliant pod",
+			pod:     corev1.Pod{},
+			allowed: true,
+		},
+		{
+			name: "every violation is listed",
+			pod: corev1.Pod{
+				Spec: corev1.PodSpec{
+					HostIPC:         true,
+					SecurityContext: &corev1.PodSecurityContext{RunAsUser: &root},
+				},
+			},
+			message: "pod violates the ThinK8S baseline: hostIPC is not allowed; pod runs as root (runAsUser=0)",
+		},
+		{
+			name: "pods cannot exempt themselves",
+			pod: corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"pod-security.kubernetes.io/enforce": "privileged"},
+				},
+				Spec: corev1.PodSpec{
+					SecurityContext: &corev1.PodSecurityContext{RunAsUser: &root},
+				},
+			},
+			message: "pod violates the ThinK8S baseline: pod runs as root (runAsUser=0)",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ar := v1.AdmissionReview{
+				Request: &v1.AdmissionRequest{
+					Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+					Operation: v1.Create,
+					Object:    runtime.RawExtension{Raw: mustMarshal(tc.pod)},
+				},
+			}
+			response := validateSecurityContext(ar, webhook.Codecs())
+			require.Equal(t, tc.allowed, response.Allowed)
+			if tc.allowed {
+				require.Nil(t, response.Result)
+				return
+			}
+			require.Equal(t, int32(http.StatusForbidden), response.Result.Code)
+			require.Equal(t, metav1.StatusReasonForbidden, response.Result.Reason)
+			require.Equal(t, tc.message, response.Result.Message)
+		})
+	}
+}
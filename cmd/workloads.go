@@ -0,0 +1,113 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/warpcomdev/think8shook/internal/webhook"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+func init() {
+	utilruntime.Must(appsv1.AddToScheme(webhook.Scheme()))
+	utilruntime.Must(batchv1.AddToScheme(webhook.Scheme()))
+}
+
+// Paths of the pod template inside the workload objects
+const (
+	templatePath    = "/spec/template"
+	jobTemplatePath = "/spec/jobTemplate/spec/template"
+)
+
+// podDecoderFunc decodes the admitted object and returns the pod to mutate,
+// along with the JSON pointer of the pod inside the object
+type podDecoderFunc func(raw []byte, deserializer runtime.Decoder) (*corev1.Pod, string, error)
+
+// podDecoders supported by podAdmission, by resource
+var podDecoders = map[metav1.GroupVersionResource]podDecoderFunc{
+	{Group: "", Version: "v1", Resource: "pods"}: func(raw []byte, deserializer runtime.Decoder) (*corev1.Pod, string, error) {
+		pod := &corev1.Pod{}
+		if _, _, err := deserializer.Decode(raw, nil, pod); err != nil {
+			return nil, "", err
+		}
+		return pod, "", nil
+	},
+	{Group: "apps", Version: "v1", Resource: "deployments"}: func(raw []byte, deserializer runtime.Decoder) (*corev1.Pod, string, error) {
+		obj := &appsv1.Deployment{}
+		if _, _, err := deserializer.Decode(raw, nil, obj); err != nil {
+			return nil, "", err
+		}
+		return templatePod(obj.ObjectMeta, obj.Spec.Template), templatePath, nil
+	},
+	{Group: "apps", Version: "v1", Resource: "statefulsets"}: func(raw []byte, deserializer runtime.Decoder) (*corev1.Pod, string, error) {
+		obj := &appsv1.StatefulSet{}
+		if _, _, err := deserializer.Decode(raw, nil, obj); err != nil {
+			return nil, "", err
+		}
+		return templatePod(obj.ObjectMeta, obj.Spec.Template), templatePath, nil
+	},
+	{Group: "apps", Version: "v1", Resource: "daemonsets"}: func(raw []byte, deserializer runtime.Decoder) (*corev1.Pod, string, error) {
+		obj := &appsv1.DaemonSet{}
+		if _, _, err := deserializer.Decode(raw, nil, obj); err != nil {
+			return nil, "", err
+		}
+		return templatePod(obj.ObjectMeta, obj.Spec.Template), templatePath, nil
+	},
+	{Group: "batch", Version: "v1", Resource: "jobs"}: func(raw []byte, deserializer runtime.Decoder) (*corev1.Pod, string, error) {
+		obj := &batchv1.Job{}
+		if _, _, err := deserializer.Decode(raw, nil, obj); err != nil {
+			return nil, "", err
+		}
+		return templatePod(obj.ObjectMeta, obj.Spec.Template), templatePath, nil
+	},
+	{Group: "batch", Version: "v1", Resource: "cronjobs"}: func(raw []byte, deserializer runtime.Decoder) (*corev1.Pod, string, error) {
+		obj := &batchv1.CronJob{}
+		if _, _, err := deserializer.Decode(raw, nil, obj); err != nil {
+			return nil, "", err
+		}
+		return templatePod(obj.ObjectMeta, obj.Spec.JobTemplate.Spec.Template), jobTemplatePath, nil
+	},
+}
+
+// templatePod builds a pod from a workload pod template, so that the
+// pod mutators can be applied to it. Paths of the patches generated
+// for this pod are relative to the template.
+func templatePod(owner metav1.ObjectMeta, template corev1.PodTemplateSpec) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: template.ObjectMeta,
+		Spec:       template.Spec,
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = owner.Namespace
+	}
+	return pod
+}
+
+// decodePod decodes the pod or pod template in the admitted object
+func decodePod(resource metav1.GroupVersionResource, raw []byte, deserializer runtime.Decoder) (*corev1.Pod, string, error) {
+	decoder, ok := podDecoders[resource]
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported resource %s", resource)
+	}
+	return decoder(raw, deserializer)
+}
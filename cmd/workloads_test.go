@@ -0,0 +1,121 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/warpcomdev/think8shook/internal/webhook"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestWorkloadTemplates(t *testing.T) {
+	template := corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "test", Image: "busybox/latest"}},
+		},
+	}
+	testCases := []struct {
+		name     string
+		resource metav1.GroupVersionResource
+		object   runtime.Object
+		template func(obj runtime.Object) corev1.PodTemplateSpec
+	}{
+		{
+			name:     "deployment",
+			resource: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+			object:   &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: template}},
+			template: func(obj runtime.Object) corev1.PodTemplateSpec { return obj.(*appsv1.Deployment).Spec.Template },
+		},
+		{
+			name:     "statefulset",
+			resource: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"},
+			object:   &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Template: template}},
+			template: func(obj runtime.Object) corev1.PodTemplateSpec { return obj.(*appsv1.StatefulSet).Spec.Template },
+		},
+		{
+			name:     "daemonset",
+			resource: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "daemonsets"},
+			object:   &appsv1.DaemonSet{Spec: appsv1.DaemonSetSpec{Template: template}},
+			template: func(obj runtime.Object) corev1.PodTemplateSpec { return obj.(*appsv1.DaemonSet).Spec.Template },
+		},
+		{
+			name:     "job",
+			resource: metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"},
+			object:   &batchv1.Job{Spec: batchv1.JobSpec{Template: template}},
+			template: func(obj runtime.Object) corev1.PodTemplateSpec { return obj.(*batchv1.Job).Spec.Template },
+		},
+		{
+			name:     "cronjob",
+			resource: metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "cronjobs"},
+			object: &batchv1.CronJob{Spec: batchv1.CronJobSpec{
+				JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: template}},
+			}},
+			template: func(obj runtime.Object) corev1.PodTemplateSpec {
+				return obj.(*batchv1.CronJob).Spec.JobTemplate.Spec.Template
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := mustMarshal(tc.object)
+			ar := v1.AdmissionReview{
+				Request: &v1.AdmissionRequest{
+					Resource:  tc.resource,
+					Namespace: "default",
+					Operation: v1.Create,
+					Object:    runtime.RawExtension{Raw: raw},
+				},
+			}
+			response := mutateSecurityContext(ar, webhook.Codecs())
+			require.True(t, response.Allowed)
+			require.NotEmpty(t, response.Patch)
+			patch, err := jsonpatch.DecodePatch(response.Patch)
+			require.NoError(t, err)
+			patched, err := patch.Apply(raw)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(patched, tc.object))
+
+			mutated := tc.template(tc.object)
+			require.NotNil(t, mutated.Spec.SecurityContext)
+			require.Equal(t, int64(InjectedUID), *mutated.Spec.SecurityContext.RunAsUser)
+			require.NotNil(t, mutated.Spec.Containers[0].SecurityContext)
+			require.Equal(t, []corev1.Capability{"ALL"}, mutated.Spec.Containers[0].SecurityContext.Capabilities.Drop)
+		})
+	}
+}
+
+func TestUnsupportedResource(t *testing.T) {
+	ar := v1.AdmissionReview{
+		Request: &v1.AdmissionRequest{
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "configmaps"},
+			Operation: v1.Create,
+			Object:    runtime.RawExtension{Raw: mustMarshal(corev1.ConfigMap{})},
+		},
+	}
+	response := mutateSecurityContext(ar, webhook.Codecs())
+	require.NotNil(t, response)
+	require.False(t, response.Allowed)
+}
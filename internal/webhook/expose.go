@@ -21,6 +21,7 @@ import (
 
 	v1 "k8s.io/api/admission/v1"
 	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	// TODO: try this library to see if it generates correct json patch
 	// https://github.com/mattbaird/jsonpatch
@@ -53,6 +54,10 @@ func Codecs() *serializer.CodecFactory {
 	return &codecs
 }
 
+func Scheme() *runtime.Scheme {
+	return scheme
+}
+
 func (config Config) TLS() *tls.Config {
 	return configTLS(config)
 }